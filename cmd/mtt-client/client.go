@@ -37,13 +37,58 @@ func main() {
 	commandLine := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
 
 	commandLine.StringVar(&c.BindAddr, "b", "", "[Host:Port] Bind address, e.g. '127.0.0.1:1080'")
-	commandLine.StringVar(&c.RemoteAddr, "s", "", "[Host:Port] Server address")
+	commandLine.StringVar(&c.RemoteAddr, "s", "", "[Host:Port] Server address. Multiple servers are separated by ',', each server can be 'Host:Port|ServerName|WSSPath'")
+	commandLine.StringVar(&c.LoadBalance, "lb", "rr", "Load balance policy if there are multiple servers: 'rr' round-robin, 'random', 'lc' least connections")
+	commandLine.DurationVar(&c.HealthCheckInterval, "health-check", 0, "The interval of active health check, e.g. '30s'. Client will dial the healthiest, lowest-latency address of the server. 0 means disabled.")
 	commandLine.BoolVar(&c.EnableWSS, "wss", false, "Enable WebSocket Secure protocol")
 	commandLine.StringVar(&c.WSSPath, "wss-path", "/", "WebSocket path")
+	commandLine.BoolVar(&c.EnableHTTPUpgrade, "http-upgrade", false, "Use raw HTTP Upgrade instead of WebSocket framing, needs wss")
+	commandLine.BoolVar(&c.EnableGRPC, "grpc", false, "Enable gRPC (HTTP/2) transport")
+	commandLine.StringVar(&c.GRPCServiceName, "grpc-service", "mtt.Tunnel", "gRPC service name, the path of HTTP request will be '/ServiceName/Tun'")
+	commandLine.BoolVar(&c.EnableSplitHTTP, "split-http", false, "Enable split HTTP transport, for CDNs that don't support WebSocket")
+	commandLine.StringVar(&c.SplitHTTPPath, "split-http-path", "/split/", "Split HTTP path prefix")
+	commandLine.BoolVar(&c.EnableQUIC, "quic", false, "Enable QUIC transport, it always enables dst-header")
 	commandLine.StringVar(&c.ServerName, "n", "", "Server name. Use to verify the hostname and to support virtual hosting.")
 	commandLine.BoolVar(&c.InsecureSkipVerify, "sv", false, "Skip verify. Client won't verify the server's certificate chain and host name.")
+	commandLine.StringVar(&c.CA, "ca", "", "[Path] CA bundle to verify server's certificate. Empty means using the system's.")
+	commandLine.StringVar(&c.CertPins, "pin", "", "Base64 encoded SHA-256 hashes of server's SubjectPublicKeyInfo, separated by ','. If ca is empty, server is verified by pins only.")
+	commandLine.StringVar(&c.ClientCert, "client-cert", "", "[Path] X509KeyPair cert file presented to server if server requires client certificates")
+	commandLine.StringVar(&c.ClientKey, "client-key", "", "[Path] X509KeyPair key file presented to server if server requires client certificates")
+	//tls options
+	commandLine.StringVar(&c.TLSMinVersion, "tls-min", "", "Minimum TLS version, '1.0', '1.1', '1.2' or '1.3'")
+	commandLine.StringVar(&c.TLSMaxVersion, "tls-max", "", "Maximum TLS version, '1.0', '1.1', '1.2' or '1.3'")
+	commandLine.StringVar(&c.TLSCipherSuites, "tls-ciphers", "", "TLS 1.0-1.2 cipher suites, separated by ','. e.g. 'TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256'")
+	commandLine.StringVar(&c.TLSCurves, "tls-curves", "", "Curve preferences, separated by ','. 'X25519', 'P256', 'P384' or 'P521'")
+	commandLine.StringVar(&c.ALPN, "alpn", "", "ALPN protocols, separated by ','. e.g. 'h2,http/1.1'")
 	commandLine.BoolVar(&c.EnableMux, "mux", false, "Enable multiplex")
-	commandLine.IntVar(&c.MuxMaxStream, "mux-max-stream", 4, "The max number of multiplexed streams in one ture TCP connection, 1-16")
+	commandLine.StringVar(&c.Muxer, "muxer", core.MuxerSmux, "Multiplexer protocol, 'smux' or 'yamux'. Server detects it automatically.")
+	commandLine.BoolVar(&c.MuxALPN, "mux-alpn", false, "(Raw TLS mode only) Tell server whether mux is enabled by ALPN, so mux doesn't need to be consistent. It needs a server that supports it.")
+	commandLine.StringVar(&c.PSK, "psk", "", "(Raw TLS or split-http mode only) Pre-shared key to authenticate clients. Empty means disabled.")
+	commandLine.IntVar(&c.MuxMaxStream, "mux-max-stream", 4, "The max number of multiplexed streams in one ture TCP connection, it should not be larger than server's")
+	commandLine.IntVar(&c.ConnPoolSize, "pool", 0, "(Non-mux mode only) The number of pre-established idle server connections. It needs dst-header. 0 means disabled.")
+	commandLine.DurationVar(&c.ConnPoolMaxIdle, "pool-max-idle", time.Minute, "The max idle time of pooled connections, at least 1s")
+	commandLine.DurationVar(&c.MuxIdleTimeout, "mux-idle-timeout", 10*time.Second, "How long an idle multiplexed connection is kept for new streams")
+	commandLine.DurationVar(&c.MuxMaxAge, "mux-max-age", 0, "The max age of a multiplexed connection, it won't accept new streams after that. 0 means unlimited.")
+	commandLine.Int64Var(&c.MuxMaxBytes, "mux-max-bytes", 0, "The max bytes transferred by a multiplexed connection, it won't accept new streams after that. 0 means unlimited.")
+	commandLine.BoolVar(&c.MuxSpareSession, "mux-spare", false, "Keep a spare multiplexed connection, so new streams don't wait for handshakes when others are full")
+	//smux options
+	commandLine.IntVar(&c.SmuxVersion, "smux-ver", 1, "Smux protocol version, 1 or 2 (per-stream flow control). It must be the same on client and server.")
+	commandLine.IntVar(&c.SmuxMaxFrameSize, "smux-frame-size", 16*1024, "Smux max frame size in bytes, max 65535")
+	commandLine.IntVar(&c.SmuxMaxReceiveBuffer, "smux-recv-buf", 256*1024, "Smux max receive buffer of a connection in bytes")
+	commandLine.IntVar(&c.SmuxMaxStreamBuffer, "smux-stream-buf", 64*1024, "(Smux v2 only) Smux max receive buffer of a stream in bytes")
+	commandLine.DurationVar(&c.SmuxKeepAliveInterval, "smux-keepalive", 30*time.Second, "Smux keepalive interval")
+	commandLine.DurationVar(&c.SmuxKeepAliveTimeout, "smux-keepalive-timeout", 70*time.Second, "Smux keepalive timeout, it must not be less than smux-keepalive")
+	//udp
+	commandLine.BoolVar(&c.EnableUDP, "udp", false, "Relay UDP datagrams from bind address")
+	commandLine.DurationVar(&c.UDPTimeout, "udp-timeout", time.Minute, "The idle timeout for UDP sessions")
+	//proxy inbounds
+	commandLine.StringVar(&c.Socks5Addr, "socks5", "", "[Host:Port] Socks5 bind address. Requested destinations will be sent to server.")
+	commandLine.StringVar(&c.Socks5User, "socks5-user", "", "Socks5 username. Empty means no authentication.")
+	commandLine.StringVar(&c.Socks5Pass, "socks5-pass", "", "Socks5 password")
+	commandLine.StringVar(&c.HTTPProxyAddr, "http-proxy", "", "[Host:Port] HTTP proxy bind address. Requested destinations will be sent to server.")
+	commandLine.StringVar(&c.HTTPProxyUser, "http-proxy-user", "", "HTTP proxy username. Empty means no authentication.")
+	commandLine.StringVar(&c.HTTPProxyPass, "http-proxy-pass", "", "HTTP proxy password")
+	commandLine.BoolVar(&c.EnableDstHeader, "dst-header", false, "Send destination header to server. It's always enabled if there is a proxy inbound.")
 	//tcp options
 	commandLine.DurationVar(&c.Timeout, "timeout", 5*time.Minute, "The idle timeout for connections")
 	commandLine.BoolVar(&c.EnableTFO, "fast-open", false, "(Linux kernel 4.11+ only) Enable TCP fast open")
@@ -75,6 +120,16 @@ func main() {
 		if err := commandLine.Parse(opts); err != nil {
 			logrus.Error(err)
 		}
+
+		// -u was ignored before udp relay, only follow it if dst-header
+		// is set, so the old setups still work.
+		if sip003Args.UDP && !c.EnableUDP {
+			if c.EnableDstHeader {
+				c.EnableUDP = true
+			} else {
+				logrus.Warn("sip003 -u is ignored, add dst-header to plugin options to relay udp")
+			}
+		}
 	} else {
 		err := commandLine.Parse(os.Args[1:])
 		if err != nil {
@@ -40,12 +40,30 @@ func main() {
 	commandLine.BoolVar(&c.ServerBindUnix, "bind-unix", false, "Bind on a Unix domain socket")
 	commandLine.StringVar(&c.HTTPControllerAddr, "c", "", "[Host:Port] Controller address")
 	commandLine.BoolVar(&c.EnableMux, "mux", false, "Enable multiplex")
+	commandLine.IntVar(&c.MuxMaxStream, "mux-max-stream", 16, "The max number of multiplexed streams a client can open in one connection, extra streams will be rejected")
+	commandLine.BoolVar(&c.EnableGRPC, "grpc", false, "Enable HTTP/2, so users can connect by gRPC transport. Their paths should be '/ServiceName/Tun'")
+	commandLine.BoolVar(&c.EnableRawTLS, "raw-tls", false, "Serve users in raw TLS mode instead of wss. Users are identified by the TLS server name or psk")
 	commandLine.DurationVar(&c.Timeout, "timeout", time.Minute, "The idle timeout for connections")
 
 	commandLine.StringVar(&c.Cert, "cert", "", "[Path] X509KeyPair cert file")
 	commandLine.StringVar(&c.Key, "key", "", "[Path] X509KeyPair key file")
+	commandLine.StringVar(&c.ClientCA, "client-ca", "", "[Path] CA bundle to verify client certificates. Empty means client certificates are not requested.")
+	commandLine.StringVar(&c.ClientAuth, "client-auth", "", "Client certificate verification mode, 'require' or 'optional' (default 'require' if client-ca is set)")
 	commandLine.BoolVar(&c.DisableTLS, "disable-tls", false, "disable TLS. An extra TLS proxy is required, such as Nginx SSL Stream Module")
 	commandLine.StringVar(&c.ServerName, "n", "", "Server name. Use to generate self signed certificate DNSName")
+	//smux options
+	commandLine.IntVar(&c.SmuxVersion, "smux-ver", 1, "Smux protocol version, 1 or 2 (per-stream flow control). It must be the same on client and server.")
+	commandLine.IntVar(&c.SmuxMaxFrameSize, "smux-frame-size", 16*1024, "Smux max frame size in bytes, max 65535")
+	commandLine.IntVar(&c.SmuxMaxReceiveBuffer, "smux-recv-buf", 256*1024, "Smux max receive buffer of a connection in bytes")
+	commandLine.IntVar(&c.SmuxMaxStreamBuffer, "smux-stream-buf", 64*1024, "(Smux v2 only) Smux max receive buffer of a stream in bytes")
+	commandLine.DurationVar(&c.SmuxKeepAliveInterval, "smux-keepalive", 30*time.Second, "Smux keepalive interval")
+	commandLine.DurationVar(&c.SmuxKeepAliveTimeout, "smux-keepalive-timeout", 70*time.Second, "Smux keepalive timeout, it must not be less than smux-keepalive")
+	//tls options
+	commandLine.StringVar(&c.TLSMinVersion, "tls-min", "", "Minimum TLS version, '1.0', '1.1', '1.2' or '1.3'")
+	commandLine.StringVar(&c.TLSMaxVersion, "tls-max", "", "Maximum TLS version, '1.0', '1.1', '1.2' or '1.3'")
+	commandLine.StringVar(&c.TLSCipherSuites, "tls-ciphers", "", "TLS 1.0-1.2 cipher suites, separated by ','. e.g. 'TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256'")
+	commandLine.StringVar(&c.TLSCurves, "tls-curves", "", "Curve preferences, separated by ','. 'X25519', 'P256', 'P384' or 'P521'")
+	commandLine.StringVar(&c.ALPN, "alpn", "", "ALPN protocols, separated by ','. e.g. 'h2,http/1.1'")
 
 	commandLine.BoolVar(&c.EnableTFO, "fast-open", false, "(Linux kernel 4.11+ only) Enable TCP fast open")
 	//debug only
@@ -39,15 +39,43 @@ func main() {
 	commandLine.StringVar(&c.BindAddr, "b", "", "[Host:Port] or [Path](if bind-unix) Server bind address, e.g. '127.0.0.1:1080', '/run/mmt-server', '@mmt-server'")
 	commandLine.BoolVar(&c.BindUnix, "bind-unix", false, "Bind on unix socket instead of TCP socket.")
 	commandLine.StringVar(&c.DstAddr, "d", "", "[Host:Port] Destination address")
+	commandLine.StringVar(&c.SNIRoutes, "sni-routes", "", "Route connections to destinations and certificates by TLS server name, e.g. 'a.example.com|127.0.0.1:8001|a.crt|a.key,*.example.com|127.0.0.1:8002'. Others go to -d")
+	commandLine.BoolVar(&c.EnableDstHeader, "dst-header", false, "Read destination from the header sent by client. Required by client's proxy inbounds, e.g. socks5.")
+	commandLine.StringVar(&c.Fallback, "fallback", "", "[URL] or [Path] Serve connections that are not from clients by this http(s) URL (reverse proxy) or directory (static files). Empty means they will be dropped.")
+	commandLine.StringVar(&c.DstAllowList, "dst-allow", "", "Allowed destinations of dst-header, separated by ','. e.g. 'example.com,*.example.com:443,10.0.0.0/8'. Empty means all destinations except internal addresses are allowed.")
 
 	commandLine.StringVar(&c.Cert, "cert", "", "[Path] X509KeyPair cert file")
 	commandLine.StringVar(&c.Key, "key", "", "[Path] X509KeyPair key file")
+	commandLine.StringVar(&c.ClientCA, "client-ca", "", "[Path] CA bundle to verify client certificates. Empty means client certificates are not requested.")
+	commandLine.StringVar(&c.ClientAuth, "client-auth", "", "Client certificate verification mode, 'require' or 'optional' (default 'require' if client-ca is set)")
 	commandLine.BoolVar(&c.DisableTLS, "disable-tls", false, "disable TLS. An extra TLS proxy is required, such as Nginx SSL Stream Module")
 	commandLine.StringVar(&c.ServerName, "n", "", "Server name. Use to generate self signed certificate DNSName")
+	//smux options
+	commandLine.IntVar(&c.SmuxVersion, "smux-ver", 1, "Smux protocol version, 1 or 2 (per-stream flow control). It must be the same on client and server.")
+	commandLine.IntVar(&c.SmuxMaxFrameSize, "smux-frame-size", 16*1024, "Smux max frame size in bytes, max 65535")
+	commandLine.IntVar(&c.SmuxMaxReceiveBuffer, "smux-recv-buf", 256*1024, "Smux max receive buffer of a connection in bytes")
+	commandLine.IntVar(&c.SmuxMaxStreamBuffer, "smux-stream-buf", 64*1024, "(Smux v2 only) Smux max receive buffer of a stream in bytes")
+	commandLine.DurationVar(&c.SmuxKeepAliveInterval, "smux-keepalive", 30*time.Second, "Smux keepalive interval")
+	commandLine.DurationVar(&c.SmuxKeepAliveTimeout, "smux-keepalive-timeout", 70*time.Second, "Smux keepalive timeout, it must not be less than smux-keepalive")
+	//tls options
+	commandLine.StringVar(&c.TLSMinVersion, "tls-min", "", "Minimum TLS version, '1.0', '1.1', '1.2' or '1.3'")
+	commandLine.StringVar(&c.TLSMaxVersion, "tls-max", "", "Maximum TLS version, '1.0', '1.1', '1.2' or '1.3'")
+	commandLine.StringVar(&c.TLSCipherSuites, "tls-ciphers", "", "TLS 1.0-1.2 cipher suites, separated by ','. e.g. 'TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256'")
+	commandLine.StringVar(&c.TLSCurves, "tls-curves", "", "Curve preferences, separated by ','. 'X25519', 'P256', 'P384' or 'P521'")
+	commandLine.StringVar(&c.ALPN, "alpn", "", "ALPN protocols, separated by ','. e.g. 'h2,http/1.1'")
 
+	commandLine.BoolVar(&c.EnableUDP, "udp", false, "Relay UDP datagrams from client. It needs dst-header.")
 	commandLine.BoolVar(&c.EnableWSS, "wss", false, "Enable WebSocket Secure protocol")
 	commandLine.StringVar(&c.WSSPath, "wss-path", "/", "WebSocket path")
+	commandLine.BoolVar(&c.EnableGRPC, "grpc", false, "Enable gRPC (HTTP/2) transport")
+	commandLine.StringVar(&c.GRPCServiceName, "grpc-service", "mtt.Tunnel", "gRPC service name, the path of HTTP request will be '/ServiceName/Tun'")
+	commandLine.BoolVar(&c.EnableSplitHTTP, "split-http", false, "Enable split HTTP transport, for CDNs that don't support WebSocket")
+	commandLine.StringVar(&c.SplitHTTPPath, "split-http-path", "/split/", "Split HTTP path prefix")
+	commandLine.BoolVar(&c.EnableRawTLS, "raw-tls", false, "Also accept raw TLS clients on the same port if wss, grpc or split-http is enabled")
+	commandLine.BoolVar(&c.EnableQUIC, "quic", false, "Enable QUIC transport, it always enables dst-header")
 	commandLine.BoolVar(&c.EnableMux, "mux", false, "Enable multiplex")
+	commandLine.IntVar(&c.MuxMaxStream, "mux-max-stream", 16, "The max number of multiplexed streams a client can open in one connection, extra streams will be rejected")
+	commandLine.StringVar(&c.PSK, "psk", "", "(Non-wss mode, raw-tls or split-http only) Pre-shared key to authenticate raw TLS and split-http clients. Empty means disabled.")
 	//tcp options
 	commandLine.DurationVar(&c.Timeout, "timeout", 5*time.Minute, "The idle timeout for connections")
 	commandLine.BoolVar(&c.EnableTFO, "fast-open", false, "(Linux kernel 4.11+ only) Enable TCP fast open")
@@ -73,6 +101,16 @@ func main() {
 		if err := commandLine.Parse(opts); err != nil {
 			logrus.Error(err)
 		}
+
+		// -u was ignored before udp relay, only follow it if dst-header
+		// is set, so the old setups still work.
+		if sip003Args.UDP && !c.EnableUDP {
+			if c.EnableDstHeader {
+				c.EnableUDP = true
+			} else {
+				logrus.Warn("sip003 -u is ignored, add dst-header to plugin options to relay udp")
+			}
+		}
 	} else {
 		err := commandLine.Parse(os.Args[1:])
 		if err != nil {
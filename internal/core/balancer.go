@@ -0,0 +1,187 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//load balance policies
+const (
+	LoadBalanceRoundRobin = "rr"
+	LoadBalanceRandom     = "random"
+	LoadBalanceLeastConn  = "lc"
+)
+
+//RemoteServer is a mtt-server that client can connect to
+type RemoteServer struct {
+	Addr       string
+	ServerName string
+	WSSPath    string
+}
+
+// ParseRemoteServers parses a list of servers, e.g. `host1:443,host2:443|server.name|/path`.
+// Servers are separated by ',', and each of them is `Addr[|ServerName[|WSSPath]]`.
+func ParseRemoteServers(s string) ([]RemoteServer, error) {
+	rs := make([]RemoteServer, 0)
+	for _, str := range strings.Split(s, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+
+		fields := strings.Split(str, "|")
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("invalid server [%s]", str)
+		}
+		r := RemoteServer{Addr: fields[0]}
+		if len(fields) > 1 {
+			r.ServerName = fields[1]
+		}
+		if len(fields) > 2 {
+			r.WSSPath = fields[2]
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// remoteServer is a remote server and its state.
+type remoteServer struct {
+	addr string
+
+	tlsConf  *tls.Config
+	wssURL   string
+	wsDialer *websocket.Dialer
+
+	grpcURL       string
+	splitHTTPURL  string
+	httpTransport *http.Transport // used by grpc and split http
+	quicConn      quicClientConn
+
+	activeConns int32 // atomic
+	failedUntil int64 // atomic, unix nano
+
+	addrStats addrStats
+}
+
+func (s *remoteServer) isFailed(now time.Time) bool {
+	return atomic.LoadInt64(&s.failedUntil) > now.UnixNano()
+}
+
+// trackConn counts c as an active connection of s until c is closed.
+func (s *remoteServer) trackConn(c net.Conn) net.Conn {
+	atomic.AddInt32(&s.activeConns, 1)
+	return &trackedConn{Conn: c, onClose: func() { atomic.AddInt32(&s.activeConns, -1) }}
+}
+
+type trackedConn struct {
+	net.Conn
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// balancer picks a server from servers according to the policy.
+// Failed servers will be taken out of rotation for failTimeout.
+type balancer struct {
+	servers     []*remoteServer
+	policy      string
+	failTimeout time.Duration
+
+	rrCounter uint32 // atomic
+}
+
+func newBalancer(servers []*remoteServer, policy string, failTimeout time.Duration) (*balancer, error) {
+	switch policy {
+	case "":
+		policy = LoadBalanceRoundRobin
+	case LoadBalanceRoundRobin, LoadBalanceRandom, LoadBalanceLeastConn:
+	default:
+		return nil, fmt.Errorf("unknown load balance policy [%s]", policy)
+	}
+
+	return &balancer{servers: servers, policy: policy, failTimeout: failTimeout}, nil
+}
+
+// pick picks a server that is not in tried. Healthy servers are preferred,
+// failed servers will only be picked if there are no healthy ones left.
+// pick returns nil if all servers have been tried.
+func (b *balancer) pick(tried map[*remoteServer]bool) *remoteServer {
+	now := time.Now()
+	candidates := make([]*remoteServer, 0, len(b.servers))
+	for _, s := range b.servers {
+		if !tried[s] && !s.isFailed(now) {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, s := range b.servers {
+			if !tried[s] {
+				candidates = append(candidates, s)
+			}
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	switch b.policy {
+	case LoadBalanceRandom:
+		return candidates[rand.Intn(len(candidates))]
+	case LoadBalanceLeastConn:
+		least := candidates[0]
+		for _, s := range candidates[1:] {
+			if atomic.LoadInt32(&s.activeConns) < atomic.LoadInt32(&least.activeConns) {
+				least = s
+			}
+		}
+		return least
+	default:
+		i := atomic.AddUint32(&b.rrCounter, 1)
+		return candidates[int(i%uint32(len(candidates)))]
+	}
+}
+
+func (b *balancer) markFailed(s *remoteServer) {
+	atomic.StoreInt64(&s.failedUntil, time.Now().Add(b.failTimeout).UnixNano())
+}
+
+func (b *balancer) markOK(s *remoteServer) {
+	atomic.StoreInt64(&s.failedUntil, 0)
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_ParseRemoteServers(t *testing.T) {
+	rs, err := ParseRemoteServers("a:443, b:443|b.name,c:443|c.name|/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RemoteServer{
+		{Addr: "a:443"},
+		{Addr: "b:443", ServerName: "b.name"},
+		{Addr: "c:443", ServerName: "c.name", WSSPath: "/path"},
+	}
+	if !reflect.DeepEqual(rs, want) {
+		t.Fatalf("want %v, got %v", want, rs)
+	}
+
+	if _, err := ParseRemoteServers("a:443|b|c|d"); err == nil {
+		t.Fatal("err is expected")
+	}
+}
+
+func Test_balancer(t *testing.T) {
+	servers := []*remoteServer{{addr: "a"}, {addr: "b"}, {addr: "c"}}
+
+	// round-robin should pick every server once
+	b, err := newBalancer(servers, LoadBalanceRoundRobin, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	picked := make(map[*remoteServer]bool)
+	for i := 0; i < len(servers); i++ {
+		picked[b.pick(nil)] = true
+	}
+	if len(picked) != len(servers) {
+		t.Fatalf("round-robin picked %d servers, want %d", len(picked), len(servers))
+	}
+
+	// failed servers should be taken out of rotation
+	b.markFailed(servers[0])
+	b.markFailed(servers[1])
+	for i := 0; i < 10; i++ {
+		if s := b.pick(nil); s != servers[2] {
+			t.Fatalf("picked failed server %s", s.addr)
+		}
+	}
+
+	// failed servers are still the last resort
+	if s := b.pick(map[*remoteServer]bool{servers[2]: true}); s == nil || s == servers[2] {
+		t.Fatal("failed servers should be picked if no healthy one left")
+	}
+	if s := b.pick(map[*remoteServer]bool{servers[0]: true, servers[1]: true, servers[2]: true}); s != nil {
+		t.Fatal("all servers have been tried, nil is expected")
+	}
+
+	// least connections
+	b, err = newBalancer(servers, LoadBalanceLeastConn, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		b.markOK(s)
+	}
+	c := servers[0].trackConn(dummyConn{})
+	servers[2].trackConn(dummyConn{})
+	if s := b.pick(nil); s != servers[1] {
+		t.Fatalf("least connections picked %s", s.addr)
+	}
+	c.Close()
+	c.Close() // should be counted once
+	if s := b.pick(nil); s != servers[0] {
+		t.Fatalf("least connections picked %s", s.addr)
+	}
+
+	if _, err := newBalancer(servers, "unknown", time.Minute); err == nil {
+		t.Fatal("err is expected")
+	}
+}
+
+type dummyConn struct{ net.Conn }
+
+func (dummyConn) Close() error { return nil }
@@ -24,6 +24,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
@@ -31,7 +32,6 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
-	"github.com/xtaci/smux"
 )
 
 const (
@@ -43,19 +43,24 @@ const (
 type Client struct {
 	conf *ClientConfig
 
-	tlsConf   *tls.Config
 	tcpConfig *tcpConfig
 
-	wssURL   string
-	wsDialer *websocket.Dialer
+	balancer *balancer
 
 	netDialer *net.Dialer
 
-	smuxSessPool smuxSessPool
-	smuxConfig   *smux.Config
+	connPool *connPool
+
+	muxPool *muxPool
+	muxer   *muxer
+
+	dstHeader bool
 
 	listenerLocker sync.Mutex
-	listener       net.Listener
+	listeners      []io.Closer // net.Listener and net.PacketConn
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
 
 	log *logrus.Logger
 
@@ -67,11 +72,19 @@ type Client struct {
 func NewClient(c *ClientConfig) (*Client, error) {
 	client := new(Client)
 
-	if len(c.BindAddr) == 0 {
+	if len(c.BindAddr) == 0 && len(c.Socks5Addr) == 0 && len(c.HTTPProxyAddr) == 0 {
 		return nil, errors.New("need bind address")
 	}
 
-	if len(c.RemoteAddr) == 0 {
+	remoteServers := c.RemoteServers
+	if len(remoteServers) == 0 {
+		var err error
+		remoteServers, err = ParseRemoteServers(c.RemoteAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote server address: %v", err)
+		}
+	}
+	if len(remoteServers) == 0 {
 		return nil, errors.New("need remote server address")
 	}
 
@@ -79,16 +92,82 @@ func NewClient(c *ClientConfig) (*Client, error) {
 		return nil, errors.New("timeout value must at least 1 sec")
 	}
 
-	if len(c.ServerName) == 0 { //set ServerName from RemoteAddr
-		host, _, err := net.SplitHostPort(c.RemoteAddr)
-		if err != nil {
-			return nil, errors.New("cannot get the host address from the remote server address")
+	if c.MuxMaxStream < 1 {
+		return nil, errors.New("mux max stream must be at least 1")
+	}
+	if c.MuxIdleTimeout < 0 || c.MuxMaxAge < 0 || c.MuxMaxBytes < 0 {
+		return nil, errors.New("mux idle timeout, max age and max bytes must not be negative")
+	}
+	if c.MuxIdleTimeout == 0 {
+		c.MuxIdleTimeout = muxSessIdleTimeout
+	}
+
+	if c.EnableUDP {
+		if len(c.BindAddr) == 0 {
+			return nil, errors.New("udp needs bind address")
+		}
+		if c.UDPTimeout <= 0 {
+			c.UDPTimeout = defaultUDPTimeout
 		}
-		c.ServerName = host
 	}
 
-	if c.MuxMaxStream < 1 || c.MuxMaxStream > defaultSmuxMaxStream {
-		return nil, fmt.Errorf("mux max stream should between 1 - 16")
+	if c.ConnPoolSize < 0 {
+		return nil, errors.New("conn pool size must not be negative")
+	}
+	if c.ConnPoolSize > 0 {
+		if c.EnableMux {
+			return nil, errors.New("conn pool can't be used with mux")
+		}
+		if !c.EnableDstHeader {
+			// server would dial the destination as soon as a conn is pooled
+			return nil, errors.New("conn pool needs dst header, the server needs it too")
+		}
+		if c.ConnPoolMaxIdle <= 0 {
+			c.ConnPoolMaxIdle = defaultConnPoolMaxIdle
+		}
+		if c.ConnPoolMaxIdle < minConnPoolMaxIdle {
+			return nil, fmt.Errorf("conn pool max idle must be at least %s", minConnPoolMaxIdle)
+		}
+	}
+
+	if c.EnableGRPC {
+		if c.EnableWSS {
+			return nil, errors.New("grpc can't be used with wss")
+		}
+		if c.EnableMux {
+			return nil, errors.New("grpc can't be used with mux, it is already multiplexed")
+		}
+		if len(c.GRPCServiceName) == 0 {
+			c.GRPCServiceName = defaultGRPCServiceName
+		}
+	}
+
+	if c.EnableHTTPUpgrade && !c.EnableWSS {
+		return nil, errors.New("http upgrade needs wss")
+	}
+
+	if c.EnableSplitHTTP {
+		if c.EnableWSS || c.EnableGRPC {
+			return nil, errors.New("split http can't be used with wss or grpc")
+		}
+		c.SplitHTTPPath = normalizeSplitHTTPPath(c.SplitHTTPPath)
+	}
+
+	if c.EnableQUIC {
+		if c.EnableWSS || c.EnableGRPC || c.EnableSplitHTTP {
+			return nil, errors.New("quic can't be used with wss, grpc or split http")
+		}
+		if c.EnableMux {
+			return nil, errors.New("quic can't be used with mux, it is already multiplexed")
+		}
+	}
+
+	if len(c.PSK) != 0 && (c.EnableWSS || c.EnableGRPC || c.EnableQUIC) {
+		return nil, errors.New("psk can only be used in raw tls or split http mode")
+	}
+
+	if c.HealthCheckInterval < 0 {
+		return nil, errors.New("health check interval must not be negative")
 	}
 
 	//init
@@ -103,11 +182,6 @@ func NewClient(c *ClientConfig) (*Client, error) {
 
 	//config
 	client.tcpConfig = &tcpConfig{tfo: c.EnableTFO, vpnMode: c.VpnMode}
-	client.tlsConf = &tls.Config{
-		InsecureSkipVerify: c.InsecureSkipVerify,
-		ServerName:         c.ServerName,
-		ClientSessionCache: tls.NewLRUClientSessionCache(16),
-	}
 
 	//net dialer
 	client.netDialer = &net.Dialer{
@@ -115,29 +189,51 @@ func NewClient(c *ClientConfig) (*Client, error) {
 		Timeout: defaultHandShakeTimeout,
 	}
 
-	//ws
-	if !strings.HasPrefix(c.WSSPath, "/") {
-		c.WSSPath = "/" + c.WSSPath
+	//tls config shared by all servers
+	tlsConf := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if err := c.TLSOptions.apply(tlsConf); err != nil {
+		return nil, err
 	}
-	client.wssURL = "wss://" + c.ServerName + c.WSSPath
-	internelDial := func(network, addr string) (net.Conn, error) {
-		// overwrite url host addr
-		return client.dialServerRaw()
+	if len(c.ClientCert) != 0 || len(c.ClientKey) != 0 {
+		cer, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client key and cert, %v", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cer}
+	}
+	if len(c.CA) != 0 {
+		rootCAs, err := loadCertPool(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA, %v", err)
+		}
+		tlsConf.RootCAs = rootCAs
+	}
+	if len(c.CertPins) != 0 {
+		pins, err := parseCertPins(c.CertPins)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cert pins: %v", err)
+		}
+		// pins alone are enough to verify a self-signed certificate
+		if tlsConf.RootCAs == nil {
+			tlsConf.InsecureSkipVerify = true
+		}
+		tlsConf.VerifyConnection = pins.verifyConnection
 	}
-	client.wsDialer = &websocket.Dialer{
-		TLSClientConfig: client.tlsConf,
-		NetDial:         internelDial,
 
-		ReadBufferSize:   defaultWSIOBufferSize,
-		WriteBufferSize:  defaultWSIOBufferSize,
-		WriteBufferPool:  &sync.Pool{},
-		HandshakeTimeout: defaultHandShakeTimeout,
+	//remote servers
+	servers := make([]*remoteServer, 0, len(remoteServers))
+	for _, rs := range remoteServers {
+		s, err := client.newRemoteServer(c, rs, tlsConf)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, s)
 	}
-	if c.EnableMux {
-		client.wsDialer.Subprotocols = []string{websocketSubprotocolSmuxON}
-	} else {
-		client.wsDialer.Subprotocols = []string{websocketSubprotocolSmuxOFF}
+	b, err := newBalancer(servers, c.LoadBalance, defaultServerFailTimeout)
+	if err != nil {
+		return nil, err
 	}
+	client.balancer = b
 
 	// fallback dns
 	if len(c.FallbackDNS) != 0 {
@@ -155,36 +251,210 @@ func NewClient(c *ClientConfig) (*Client, error) {
 		}
 	}
 
-	//smux pool
-	client.smuxSessPool = smuxSessPool{}
+	//mux pool
+	client.muxPool = newMuxPool(c.MuxMaxStream, c.MuxSpareSession, func() (*muxSession, error) {
+		sess, err := client.dialNewMuxSess()
+		if err != nil {
+			return nil, err
+		}
+		return newMuxSession(sess, c.MuxMaxAge, c.MuxMaxBytes), nil
+	}, client.log)
 
-	client.smuxConfig = defaultSmuxConfig()
+	if err := checkMuxer(c.Muxer); err != nil {
+		return nil, err
+	}
+	client.muxer, err = newMuxer(&c.SmuxOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	//conn pool
+	if c.ConnPoolSize > 0 {
+		client.connPool = newConnPool(c.ConnPoolSize, c.ConnPoolMaxIdle, client.dialServerUntracked)
+	}
+
+	client.closeNotify = make(chan struct{})
+	// proxy inbounds and udp need dst header to tell server where to go.
+	// QUIC streams need it to be seen by server.
+	client.dstHeader = c.EnableDstHeader || c.EnableUDP || c.EnableQUIC ||
+		len(c.Socks5Addr) != 0 || len(c.HTTPProxyAddr) != 0
 	client.conf = c
+
+	// ForwardConn can be used without Start, so sessions are reaped
+	// from now on until client is closed.
+	if c.EnableMux {
+		go client.reapMuxSessions()
+	}
 	return client, nil
 }
 
+func (client *Client) newRemoteServer(c *ClientConfig, rs RemoteServer, tlsConf *tls.Config) (*remoteServer, error) {
+	serverName := rs.ServerName
+	if len(serverName) == 0 {
+		serverName = c.ServerName
+	}
+	if len(serverName) == 0 { //set ServerName from Addr
+		host, _, err := net.SplitHostPort(rs.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get the host address from the remote server address [%s]", rs.Addr)
+		}
+		serverName = host
+	}
+
+	wssPath := rs.WSSPath
+	if len(wssPath) == 0 {
+		wssPath = c.WSSPath
+	}
+	if !strings.HasPrefix(wssPath, "/") {
+		wssPath = "/" + wssPath
+	}
+
+	s := &remoteServer{addr: rs.Addr}
+	s.tlsConf = tlsConf.Clone()
+	s.tlsConf.ServerName = serverName
+	s.tlsConf.ClientSessionCache = tls.NewLRUClientSessionCache(16)
+
+	//ws
+	s.wssURL = "wss://" + serverName + wssPath
+	internelDial := func(network, addr string) (net.Conn, error) {
+		// overwrite url host addr
+		return client.dialServerRaw(s)
+	}
+	s.wsDialer = &websocket.Dialer{
+		TLSClientConfig: s.tlsConf,
+		NetDial:         internelDial,
+
+		ReadBufferSize:   defaultWSIOBufferSize,
+		WriteBufferSize:  defaultWSIOBufferSize,
+		WriteBufferPool:  &sync.Pool{},
+		HandshakeTimeout: defaultHandShakeTimeout,
+	}
+	s.wsDialer.Subprotocols = []string{muxSubprotocol(c.EnableMux, c.Muxer)}
+	if c.EnableHTTPUpgrade {
+		// upgrade needs http/1.1
+		s.tlsConf.NextProtos = removeH2(s.tlsConf.NextProtos)
+	}
+
+	//grpc
+	if c.EnableGRPC {
+		s.tlsConf.NextProtos = addH2(s.tlsConf.NextProtos)
+		s.grpcURL = "https://" + serverName + grpcPath(c.GRPCServiceName)
+		s.httpTransport = client.newHTTPTransport(s, c.Timeout, true)
+	}
+
+	//split http
+	if c.EnableSplitHTTP {
+		if len(s.tlsConf.NextProtos) == 0 {
+			s.tlsConf.NextProtos = []string{"h2", "http/1.1"}
+		}
+		s.splitHTTPURL = "https://" + serverName + c.SplitHTTPPath
+		s.httpTransport = client.newHTTPTransport(s, c.Timeout, false)
+	}
+
+	//quic
+	if c.EnableQUIC && len(s.tlsConf.NextProtos) == 0 {
+		s.tlsConf.NextProtos = []string{quicALPN}
+	}
+
+	//raw tls, tell server whether mux is enabled
+	if c.MuxALPN && !c.EnableWSS && !c.EnableGRPC && !c.EnableSplitHTTP && !c.EnableQUIC {
+		s.tlsConf.NextProtos = append(append([]string(nil), s.tlsConf.NextProtos...), muxSubprotocol(c.EnableMux, c.Muxer))
+	}
+	return s, nil
+}
+
 //Start starts the client, it block
 func (client *Client) Start() error {
+	errChan := make(chan error, 4)
+
+	if len(client.conf.BindAddr) != 0 {
+		l, err := client.listen(client.conf.BindAddr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		client.log.Printf("plugin listen at %s", l.Addr())
+		go func() {
+			errChan <- client.serve(l, client.ForwardConn)
+		}()
+	}
+
+	if len(client.conf.Socks5Addr) != 0 {
+		l, err := client.listen(client.conf.Socks5Addr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		client.log.Printf("socks5 listen at %s", l.Addr())
+		go func() {
+			errChan <- client.serve(l, client.handleSocks5Conn)
+		}()
+	}
+
+	if client.conf.EnableUDP {
+		pc, err := net.ListenPacket("udp", client.conf.BindAddr)
+		if err != nil {
+			return fmt.Errorf("net.ListenPacket: %v", err)
+		}
+		defer pc.Close()
+		client.listenerLocker.Lock()
+		client.listeners = append(client.listeners, pc)
+		client.listenerLocker.Unlock()
+		client.log.Printf("udp listen at %s", pc.LocalAddr())
+		go func() {
+			errChan <- client.serveUDP(pc)
+		}()
+	}
+
+	if len(client.conf.HTTPProxyAddr) != 0 {
+		l, err := client.listen(client.conf.HTTPProxyAddr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		client.log.Printf("http proxy listen at %s", l.Addr())
+		go func() {
+			errChan <- client.serve(l, client.handleHTTPProxyConn)
+		}()
+	}
+
+	if client.conf.HealthCheckInterval > 0 {
+		go client.healthCheck(client.conf.HealthCheckInterval)
+	}
+
+	if client.connPool != nil {
+		go client.connPool.fill(client.closeNotify, func(err error) {
+			client.log.Errorf("conn pool: connect to remote: %v", err)
+		})
+	}
+
+	return <-errChan
+}
+
+func (client *Client) listen(addr string) (net.Listener, error) {
 	listenConfig := net.ListenConfig{Control: getControlFunc(client.tcpConfig)}
-	listener, err := listenConfig.Listen(context.Background(), "tcp", client.conf.BindAddr)
+	l, err := listenConfig.Listen(context.Background(), "tcp", addr)
 	if err != nil {
-		return fmt.Errorf("net.Listen: %v", err)
+		return nil, fmt.Errorf("net.Listen: %v", err)
 	}
-	defer listener.Close()
 	client.listenerLocker.Lock()
-	client.listener = listener
+	client.listeners = append(client.listeners, l)
 	client.listenerLocker.Unlock()
-	client.log.Printf("plugin listen at %s", listener.Addr())
+	return l, nil
+}
 
+func (client *Client) serve(l net.Listener, handleConn func(net.Conn) error) error {
 	for {
-		leftConn, err := listener.Accept()
+		leftConn, err := l.Accept()
 		if err != nil {
 			return fmt.Errorf("listener.Accept: %v", err)
 		}
 
 		go func() {
+			defer leftConn.Close()
+
 			client.log.Debugf("client connection from %s accepted", leftConn.RemoteAddr())
-			err := client.ForwardConn(leftConn)
+			err := handleConn(leftConn)
 			if err != nil {
 				client.log.Errorf("forward client connection from %s: %v", leftConn.RemoteAddr(), err)
 			}
@@ -196,80 +466,203 @@ func (client *Client) Start() error {
 //It will block until server-side connection is closed
 //or c is closed
 func (client *Client) ForwardConn(c net.Conn) error {
+	rightConn, err := client.openServerConn(dstHeaderCmdConnect, "")
+	if err != nil {
+		return err
+	}
+	defer rightConn.Close()
+
+	err = openTunnel(c, rightConn, client.conf.Timeout)
+	if err != nil {
+		return fmt.Errorf("openTunnel: %v", err)
+	}
+	return nil
+}
+
+func (client *Client) handleSocks5Conn(c net.Conn) error {
+	dst, err := socks5Handshake(c, client.conf.Socks5User, client.conf.Socks5Pass)
+	if err != nil {
+		return fmt.Errorf("socks5 handshake: %v", err)
+	}
+
+	rightConn, err := client.openServerConn(dstHeaderCmdConnect, dst)
+	if err != nil {
+		socks5Reply(c, socks5RepGeneralFailure)
+		return err
+	}
+	defer rightConn.Close()
+
+	if err := socks5Reply(c, socks5RepSucceeded); err != nil {
+		return fmt.Errorf("socks5 reply: %v", err)
+	}
+
+	err = openTunnel(c, rightConn, client.conf.Timeout)
+	if err != nil {
+		return fmt.Errorf("openTunnel: %v", err)
+	}
+	return nil
+}
+
+// openServerConn opens a connection (or a mux stream) to server. If dst
+// header is enabled, cmd and dst will be sent to server, an empty dst means
+// using the server's default destination.
+func (client *Client) openServerConn(cmd byte, dst string) (net.Conn, error) {
 	var rightConn net.Conn
 	var err error
 
 	if client.conf.EnableMux {
 		rightConn, err = client.getMuxStream()
 		if err != nil {
-			return fmt.Errorf("mux getStream: %v", err)
+			return nil, fmt.Errorf("mux getStream: %v", err)
 		}
 	} else {
-		rightConn, err = client.dialServer()
-		if err != nil {
-			return fmt.Errorf("connect to remote: %v", err)
+		if client.connPool != nil {
+			rightConn = client.connPool.get()
+		}
+		if rightConn == nil {
+			rightConn, err = client.dialServer()
+			if err != nil {
+				return nil, fmt.Errorf("connect to remote: %v", err)
+			}
 		}
 	}
-	defer rightConn.Close()
 
-	err = openTunnel(c, rightConn, client.conf.Timeout)
-	if err != nil {
-		return fmt.Errorf("openTunnel: %v", err)
+	if client.dstHeader {
+		rightConn.SetWriteDeadline(time.Now().Add(defaultHandShakeTimeout))
+		if err := writeDstHeader(rightConn, cmd, dst); err != nil {
+			rightConn.Close()
+			return nil, fmt.Errorf("write dst header: %v", err)
+		}
+		rightConn.SetWriteDeadline(time.Time{})
 	}
-	return nil
+	return rightConn, nil
 }
 
 //Close shutdown client
 func (client *Client) Close() error {
+	client.closeOnce.Do(func() { close(client.closeNotify) })
+	client.muxPool.close()
+	for _, s := range client.balancer.servers {
+		s.quicConn.close()
+	}
+
 	client.listenerLocker.Lock()
 	defer client.listenerLocker.Unlock()
-	if client.listener != nil {
-		return client.listener.Close()
+	var err error
+	for _, l := range client.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
-	return nil
+	return err
 }
 
-func (client *Client) dialWSS() (net.Conn, error) {
-	return dialWebsocketConn(client.wsDialer, client.wssURL)
+func (client *Client) dialWSS(s *remoteServer) (net.Conn, error) {
+	return dialWebsocketConn(s.wsDialer, s.wssURL)
 }
 
-func (client *Client) dialTLS() (net.Conn, error) {
-	raw, err := client.dialServerRaw()
+func (client *Client) dialTLS(s *remoteServer) (net.Conn, error) {
+	raw, err := client.dialServerRaw(s)
 	if err != nil {
 		return nil, err
 	}
-	conn := tls.Client(raw, client.tlsConf)
+	conn := tls.Client(raw, s.tlsConf)
 	if err := conn.Handshake(); err != nil {
 		conn.Close()
 		return nil, err
 	}
+	if len(client.conf.PSK) != 0 {
+		if err := writePSKPreamble(conn, client.conf.PSK); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
 	return conn, nil
 }
 
+// dialServer dials a server picked by the balancer. The connection is
+// counted as an active connection of the server until it is closed.
 func (client *Client) dialServer() (net.Conn, error) {
-	if client.conf.EnableWSS {
-		return client.dialWSS()
+	conn, s, err := client.dialServerUntracked()
+	if err != nil {
+		return nil, err
 	}
-	return client.dialTLS()
+	return s.trackConn(conn), nil
 }
 
-func (client *Client) dialServerRaw() (net.Conn, error) {
-	if client.testDialServerRaw == nil {
-		return client.netDialer.Dial("tcp", client.conf.RemoteAddr)
+// dialServerUntracked dials a server picked by the balancer. If it fails,
+// the server will be taken out of rotation and the next one will be tried.
+func (client *Client) dialServerUntracked() (net.Conn, *remoteServer, error) {
+	tried := make(map[*remoteServer]bool)
+	var lastErr error
+	for {
+		s := client.balancer.pick(tried)
+		if s == nil {
+			return nil, nil, lastErr
+		}
+		tried[s] = true
+
+		var conn net.Conn
+		var err error
+		if client.conf.EnableHTTPUpgrade {
+			conn, err = client.dialHTTPUpgrade(s)
+		} else if client.conf.EnableWSS {
+			conn, err = client.dialWSS(s)
+		} else if client.conf.EnableGRPC {
+			conn, err = client.dialGRPC(s)
+		} else if client.conf.EnableSplitHTTP {
+			conn, err = client.dialSplitHTTP(s)
+		} else if client.conf.EnableQUIC {
+			conn, err = client.dialQUIC(s)
+		} else {
+			conn, err = client.dialTLS(s)
+		}
+		if err != nil {
+			client.balancer.markFailed(s)
+			client.log.Warnf("server %s failed: %v", s.addr, err)
+			lastErr = err
+			continue
+		}
+		client.balancer.markOK(s)
+		return conn, s, nil
 	}
-	return client.testDialServerRaw()
 }
 
-type smuxSessPool struct {
-	sync.Map
+// dialServerRaw dials the best address of s from the health check results.
+// If s has not been probed, its address will be dialed directly.
+func (client *Client) dialServerRaw(s *remoteServer) (net.Conn, error) {
+	if client.testDialServerRaw != nil {
+		return client.testDialServerRaw()
+	}
+
+	addr := s.addrStats.bestAddr()
+	if len(addr) == 0 {
+		addr = s.addr
+	}
+	return client.netDialer.Dial("tcp", addr)
+}
+
+// reapMuxSessions closes and deletes idle and drained sessions until
+// client is closed.
+func (client *Client) reapMuxSessions() {
+	ticker := time.NewTicker(muxCheckIdleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			client.muxPool.reap(now, client.conf.MuxIdleTimeout)
+		case <-client.closeNotify:
+			return
+		}
+	}
 }
 
-func (client *Client) dialNewSmuxSess() (*smux.Session, error) {
+func (client *Client) dialNewMuxSess() (muxSess, error) {
 	rightConn, err := client.dialServer()
 	if err != nil {
 		return nil, err
 	}
-	sess, err := smux.Client(rightConn, client.smuxConfig)
+	sess, err := client.muxer.client(client.conf.Muxer, rightConn)
 	if err != nil {
 		rightConn.Close()
 		return nil, err
@@ -280,40 +673,5 @@ func (client *Client) dialNewSmuxSess() (*smux.Session, error) {
 }
 
 func (client *Client) getMuxStream() (*muxStream, error) {
-	var stream *muxStream
-
-	try := func(key, value interface{}) bool {
-		sess := key.(*muxSession)
-		if sess.IsClosed() {
-			client.smuxSessPool.Delete(sess)
-			client.log.Debugf("deleted closed sess %p", sess)
-			return true
-		}
-
-		// try
-		var er error
-		stream, er = sess.openStream(client.conf.MuxMaxStream)
-		if er == ErrTooManyStreams {
-			return true // this session opened too many streams, try next
-		}
-		if er != nil {
-			client.smuxSessPool.Delete(sess)
-			client.log.Warnf("deleted err sess %p: open stream: %v", sess, er)
-			return true
-		}
-		return false
-	}
-
-	client.smuxSessPool.Range(try)
-
-	if stream == nil {
-		sess, err := client.dialNewSmuxSess()
-		if err != nil {
-			return nil, err
-		}
-		muxSess := newMuxSession(sess)
-		client.smuxSessPool.Store(muxSess, nil)
-		return muxSess.openStream(client.conf.MuxMaxStream)
-	}
-	return stream, nil
+	return client.muxPool.getStream()
 }
@@ -20,29 +20,51 @@
 package core
 
 import (
+	"errors"
+	"net"
 	"sync"
-
-	"github.com/xtaci/smux"
+	"sync/atomic"
+	"time"
 )
 
+var errMuxSessionDraining = errors.New("mux session is draining")
+
+// muxSession is a client mux session. It is kept for a grace period
+// after its last stream is closed. Once it reaches its max age or max
+// bytes, it is drained: no new streams are opened on it, and it is
+// closed after its last stream is closed.
 type muxSession struct {
 	mu sync.Mutex
-	*smux.Session
+	muxSess
+
+	createdAt time.Time
+	maxAge    time.Duration // 0 means unlimited
+	maxBytes  int64         // 0 means unlimited
+	bytes     int64         // atomic, read and written by streams
+
+	idleSince time.Time // zero if there are active streams
+	draining  bool
 }
 
 type muxStream struct {
-	*smux.Stream
-	onClose func() error
+	net.Conn
+	sess *muxSession
 }
 
-func newMuxSession(s *smux.Session) *muxSession {
-	return &muxSession{Session: s}
+func newMuxSession(s muxSess, maxAge time.Duration, maxBytes int64) *muxSession {
+	now := time.Now()
+	return &muxSession{muxSess: s, createdAt: now, maxAge: maxAge, maxBytes: maxBytes, idleSince: now}
 }
 
 func (s *muxSession) openStream(maxStreamLimit int) (*muxStream, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.draining || s.expired(time.Now()) {
+		s.drainLocked()
+		return nil, errMuxSessionDraining
+	}
+
 	if s.NumStreams() >= maxStreamLimit {
 		return nil, ErrTooManyStreams
 	}
@@ -51,20 +73,79 @@ func (s *muxSession) openStream(maxStreamLimit int) (*muxStream, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &muxStream{Stream: stream, onClose: s.tryCloseOnIdle}, nil
+	s.idleSince = time.Time{}
+	return &muxStream{Conn: stream, sess: s}, nil
 }
 
-func (s *muxSession) tryCloseOnIdle() error {
+// available reports whether s can open new streams.
+func (s *muxSession) available() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return !s.IsClosed() && !s.draining && !s.expired(time.Now())
+}
+
+// expired reports whether s reaches its max age or max bytes.
+func (s *muxSession) expired(now time.Time) bool {
+	return s.maxAge > 0 && now.Sub(s.createdAt) >= s.maxAge ||
+		s.maxBytes > 0 && atomic.LoadInt64(&s.bytes) >= s.maxBytes
+}
+
+// drainLocked marks s as draining, s will be closed if it is idle.
+func (s *muxSession) drainLocked() {
+	s.draining = true
 	if s.NumStreams() == 0 {
-		return s.Close()
+		s.Close()
 	}
-	return nil
+}
+
+func (s *muxSession) onStreamClose() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.NumStreams() != 0 {
+		return
+	}
+	if s.draining {
+		s.Close()
+		return
+	}
+	s.idleSince = time.Now()
+}
+
+// reap closes s if it has been idle for idleTimeout, or it should be drained.
+// It reports whether s is closed.
+func (s *muxSession) reap(now time.Time, idleTimeout time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.IsClosed() {
+		return true
+	}
+	if s.NumStreams() == 0 && s.idleSince.IsZero() {
+		// some protocols, e.g. yamux, remove a stream after the peer
+		// closed it too, which is after onStreamClose.
+		s.idleSince = now
+	}
+	if s.draining || s.expired(now) {
+		s.drainLocked()
+	} else if !s.idleSince.IsZero() && now.Sub(s.idleSince) >= idleTimeout && s.NumStreams() == 0 {
+		s.Close()
+	}
+	return s.IsClosed()
+}
+
+func (s *muxStream) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	atomic.AddInt64(&s.sess.bytes, int64(n))
+	return n, err
+}
+
+func (s *muxStream) Write(b []byte) (int, error) {
+	n, err := s.Conn.Write(b)
+	atomic.AddInt64(&s.sess.bytes, int64(n))
+	return n, err
 }
 
 func (s *muxStream) Close() error {
-	s.Stream.Close()
-	// tryCloseOnIdle
-	return s.onClose()
+	err := s.Conn.Close()
+	s.sess.onStreamClose()
+	return err
 }
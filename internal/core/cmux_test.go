@@ -0,0 +1,118 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestMuxSession(t *testing.T, maxAge time.Duration, maxBytes int64) *muxSession {
+	c1, c2 := net.Pipe()
+	m, err := newMuxer(&SmuxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go handleClientMuxConn(m, MuxerSmux, defaultSmuxMaxStream, c2, func(c net.Conn, _ *logrus.Entry) {
+		io.Copy(c, c) // echo
+	}, logrus.NewEntry(logrus.StandardLogger()))
+
+	sess, err := m.client(MuxerSmux, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newMuxSession(sess, maxAge, maxBytes)
+}
+
+func Test_muxSession_idle(t *testing.T) {
+	s := newTestMuxSession(t, 0, 0)
+	defer s.Close()
+
+	stream, err := s.openStream(defaultSmuxMaxStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.reap(time.Now().Add(time.Hour), time.Second) {
+		t.Fatal("session with active streams should not be reaped")
+	}
+	stream.Close()
+	if s.IsClosed() {
+		t.Fatal("idle session should be kept for the grace period")
+	}
+	if s.reap(time.Now(), time.Second) {
+		t.Fatal("session should not be reaped in the grace period")
+	}
+	if !s.reap(time.Now().Add(2*time.Second), time.Second) {
+		t.Fatal("session should be reaped after the grace period")
+	}
+}
+
+func Test_muxSession_maxBytes(t *testing.T) {
+	s := newTestMuxSession(t, 0, 4)
+	defer s.Close()
+
+	stream, err := s.openStream(defaultSmuxMaxStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(time.Second))
+	if _, err := stream.Write([]byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.openStream(defaultSmuxMaxStream); err != errMuxSessionDraining {
+		t.Fatalf("want errMuxSessionDraining, got %v", err)
+	}
+
+	// the active stream still works
+	if _, err := io.ReadFull(stream, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if s.IsClosed() {
+		t.Fatal("draining session should not be closed before its streams are closed")
+	}
+	stream.Close()
+	if !s.IsClosed() {
+		t.Fatal("draining session should be closed after its streams are closed")
+	}
+}
+
+func Test_muxSession_maxAge(t *testing.T) {
+	s := newTestMuxSession(t, time.Minute, 0)
+	defer s.Close()
+
+	stream, err := s.openStream(defaultSmuxMaxStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.reap(time.Now().Add(2*time.Minute), time.Hour) {
+		t.Fatal("session with active streams should not be closed")
+	}
+	if _, err := s.openStream(defaultSmuxMaxStream); err != errMuxSessionDraining {
+		t.Fatalf("want errMuxSessionDraining, got %v", err)
+	}
+	stream.Close()
+	if !s.IsClosed() {
+		t.Fatal("draining session should be closed after its streams are closed")
+	}
+}
@@ -20,6 +20,7 @@
 package core
 
 import (
+	"bufio"
 	"io"
 	"net"
 	"os"
@@ -28,10 +29,7 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/gorilla/websocket"
-
 	"github.com/sirupsen/logrus"
-	"github.com/xtaci/smux"
 )
 
 var (
@@ -146,12 +144,18 @@ func copyBuffer(dst net.Conn, src net.Conn, buf []byte, muTimeout *atomic.Value)
 	return written, err
 }
 
-func handleClientMuxConn(smuxConfig *smux.Config, maxStream int, conn net.Conn, handleStream func(net.Conn, *logrus.Entry), requestEntry *logrus.Entry) {
-	sess, err := smux.Server(conn, smuxConfig)
+func handleClientMuxConn(m *muxer, protocol string, maxStream int, conn net.Conn, handleStream func(net.Conn, *logrus.Entry), requestEntry *logrus.Entry) {
+	sess, err := m.server(protocol, conn)
 	if err != nil {
-		requestEntry.Errorf("smux server, %v", err)
+		if !isMuxSessClosedErr(err) {
+			requestEntry.Errorf("mux server, %v", err)
+		}
+		return
 	}
 
+	// streams accepted and not yet closed, streams that are opened by
+	// client but not accepted yet are not counted.
+	var active int32
 	for {
 		if sess.IsClosed() {
 			return
@@ -159,25 +163,28 @@ func handleClientMuxConn(smuxConfig *smux.Config, maxStream int, conn net.Conn,
 		stream, err := sess.AcceptStream()
 		if err != nil {
 			// surpress expected err
-			if e, ok := err.(*websocket.CloseError); ok && e.Code == websocket.CloseNormalClosure {
-				return
-			}
-			if err == io.EOF {
+			if isMuxSessClosedErr(err) {
 				return
 			}
 
 			// warn unexpected err
-			requestEntry.Warnf("accept smux stream, %v", err)
+			requestEntry.Warnf("accept mux stream, %v", err)
 			return
 		}
-		if sess.NumStreams() > maxStream {
+		if int(atomic.LoadInt32(&active)) >= maxStream {
+			// reject this stream only, others are still working
 			stream.Close()
 			requestEntry.Warn(ErrTooManyStreams)
-			return
+			continue
 		}
-		requestEntry.Debug("accepted a smux stream")
-
-		go handleStream(stream, requestEntry)
+		requestEntry.Debug("accepted a mux stream")
+
+		atomic.AddInt32(&active, 1)
+		go func() {
+			defer stream.Close()
+			defer atomic.AddInt32(&active, -1)
+			handleStream(stream, requestEntry)
+		}()
 	}
 }
 
@@ -190,3 +197,17 @@ func listenUnix(addr string) (net.Listener, error) {
 	os.RemoveAll(addr)
 	return net.Listen("unix", addr)
 }
+
+// bufferedConn is a net.Conn that reads from r first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newBufferedConn(c net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
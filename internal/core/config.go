@@ -31,6 +31,11 @@ const (
 	defaultHandShakeTimeout = time.Second * 10
 
 	defaultSmuxMaxStream = 16
+
+	defaultServerFailTimeout = time.Second * 30
+	defaultUDPTimeout        = time.Minute
+	defaultConnPoolMaxIdle   = time.Minute
+	minConnPoolMaxIdle       = time.Second
 )
 
 func defaultSmuxConfig() *smux.Config {
@@ -48,14 +53,88 @@ func defaultSmuxConfig() *smux.Config {
 type ClientConfig struct {
 	BindAddr   string
 	RemoteAddr string
+	// RemoteServers overwrites RemoteAddr if it is not empty.
+	RemoteServers []RemoteServer
+	LoadBalance   string
+	// HealthCheckInterval is the interval of the active health check, 0 disables it.
+	HealthCheckInterval time.Duration
+
+	// Socks5Addr is the bind address of socks5 inbound, empty means disabled.
+	Socks5Addr string
+	Socks5User string
+	Socks5Pass string
+	// HTTPProxyAddr is the bind address of http proxy inbound, empty means disabled.
+	HTTPProxyAddr string
+	HTTPProxyUser string
+	HTTPProxyPass string
+	// EnableDstHeader sends a dst header at the beginning of every connection.
+	// It is always enabled if there is a proxy inbound, udp or quic is enabled.
+	// It is required by conn pool.
+	EnableDstHeader bool
+
+	// EnableUDP relays udp datagrams from BindAddr.
+	EnableUDP  bool
+	UDPTimeout time.Duration
 
-	EnableWSS    bool
-	WSSPath      string
-	EnableMux    bool
+	EnableWSS bool
+	WSSPath   string
+	// EnableHTTPUpgrade uses a raw http upgrade on the wss path instead
+	// of websocket framing. It needs wss.
+	EnableHTTPUpgrade bool
+	EnableMux         bool
+	// Muxer is the multiplexer protocol, MuxerSmux (default) or MuxerYamux.
+	Muxer string
+	// MuxALPN tells server whether mux is enabled by ALPN in raw tls mode.
+	// It changes the ClientHello, so it is off by default.
+	MuxALPN bool
+	// MuxMaxStream is the max number of streams in one session.
 	MuxMaxStream int
+	// MuxIdleTimeout is how long an idle session is kept, 0 means 10s.
+	MuxIdleTimeout time.Duration
+	// MuxMaxAge and MuxMaxBytes limit the lifetime of a session, 0 means
+	// unlimited. A session that reaches them won't accept new streams and
+	// will be closed after its streams are closed.
+	MuxMaxAge   time.Duration
+	MuxMaxBytes int64
+	// MuxSpareSession keeps a spare session with free streams.
+	MuxSpareSession bool
+	SmuxOptions
+	// EnableGRPC carries connections as gRPC streams over http2.
+	EnableGRPC      bool
+	GRPCServiceName string
+	// EnableSplitHTTP carries connections by plain http requests, a
+	// long-lived GET for download and POSTs for upload.
+	EnableSplitHTTP bool
+	SplitHTTPPath   string
+	// EnableQUIC maps every connection to a stream of a QUIC connection.
+	// Dst header is always enabled in quic mode.
+	EnableQUIC bool
+
+	// PSK is a pre-shared key, client sends a preamble signed by it to
+	// servers in raw tls and split http mode. Empty means disabled.
+	PSK string
+
+	// ConnPoolSize is the number of idle server connections kept by
+	// client in non-mux mode, 0 disables the pool.
+	ConnPoolSize int
+	// ConnPoolMaxIdle is how long a pooled connection is kept, 0 means 1m.
+	// It must be at least 1s.
+	ConnPoolMaxIdle time.Duration
 
 	ServerName         string
 	InsecureSkipVerify bool
+	// CA is the CA bundle to verify servers' certificates, empty means
+	// using the system's.
+	CA string
+	// CertPins is a list of base64 encoded SHA-256 hashes of servers'
+	// SubjectPublicKeyInfo separated by ','. If CA is empty, servers
+	// are verified by pins only, so self-signed certificates can be used.
+	CertPins string
+	TLSOptions
+	// ClientCert and ClientKey is the X509KeyPair presented to servers
+	// that require client certificates.
+	ClientCert string
+	ClientKey  string
 
 	Timeout     time.Duration
 	EnableTFO   bool
@@ -69,15 +148,63 @@ type ServerConfig struct {
 	BindAddr string
 	BindUnix bool
 	DstAddr  string
+	// SNIRoutes routes connections to destinations, and optionally
+	// certificates, by the tls server name. e.g.
+	// `a.example.com|127.0.0.1:8001|a.crt|a.key,*.example.com|127.0.0.1:8002`.
+	// Connections that match no route go to DstAddr.
+	SNIRoutes string
+
+	// EnableDstHeader reads the destination from the dst header sent by client.
+	EnableDstHeader bool
+	// DstAllowList is a list of allowed destinations separated by ','.
+	// Empty means all destinations are allowed.
+	DstAllowList string
+	// EnableUDP allows clients to relay udp datagrams. It needs dst header.
+	EnableUDP bool
+	// Fallback is a http(s) URL or a directory. Connections that are not
+	// from clients will be served by it, empty means they will be dropped.
+	Fallback string
 
 	EnableWSS bool
 	WSSPath   string
 	EnableMux bool
+	// MuxMaxStream is the max number of streams a client can open in one
+	// session, 0 means 16. Extra streams will be rejected.
+	MuxMaxStream int
+	SmuxOptions
+
+	// EnableGRPC accepts gRPC streams over http2, it can be used with wss.
+	EnableGRPC      bool
+	GRPCServiceName string
+	// EnableSplitHTTP accepts split http connections, it can be used
+	// with wss and grpc. Mux must be the same as clients'. It needs PSK or
+	// ClientCA to authenticate clients.
+	EnableSplitHTTP bool
+	SplitHTTPPath   string
+	// EnableRawTLS also accepts raw tls clients if wss, grpc or split http
+	// is enabled. Connections are sniffed, those don't start with a http
+	// request are handled in raw tls mode. If PSK is set, raw clients are
+	// told by the psk preamble instead, and PSK is not checked for wss and
+	// grpc clients.
+	EnableRawTLS bool
+	// EnableQUIC accepts QUIC connections on udp BindAddr instead of tcp.
+	// Dst header is always enabled in quic mode.
+	EnableQUIC bool
+
+	// PSK is a pre-shared key, clients must send a preamble signed by it
+	// in raw tls and split http mode. Empty means disabled.
+	PSK string
 
 	Key        string
 	Cert       string
 	ServerName string
 	DisableTLS bool
+	// ClientCA is the CA bundle to verify client certificates, empty means
+	// client certificates are not requested.
+	ClientCA string
+	// ClientAuth is ClientAuthRequire (default) or ClientAuthOptional.
+	ClientAuth string
+	TLSOptions
 
 	Timeout   time.Duration
 	EnableTFO bool
@@ -94,8 +221,19 @@ type MUServerConfig struct {
 	Cert       string
 	ServerName string
 	DisableTLS bool
+	ClientCA   string
+	ClientAuth string
+	TLSOptions
 
-	EnableMux bool
+	EnableMux    bool
+	MuxMaxStream int
+	SmuxOptions
+	// EnableGRPC enables http2, so users can connect by grpc. Their paths
+	// should be "/ServiceName/Tun".
+	EnableGRPC bool
+	// EnableRawTLS serves users in raw tls mode instead of wss, they are
+	// identified by the tls server name or psk.
+	EnableRawTLS bool
 
 	EnableTFO bool
 	Timeout   time.Duration
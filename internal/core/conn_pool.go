@@ -0,0 +1,184 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	connPoolRetryInterval = time.Second * 2
+	// server closes connections that send nothing in its timeout,
+	// which is 5 minutes by default.
+	connPoolKeepAliveInterval = time.Second * 30
+)
+
+// connPool keeps up to size idle, already handshaked server connections.
+// Connections that have been idle for maxIdle will be closed. Idle
+// connections send keepalive dst headers, so server won't close them.
+type connPool struct {
+	size    int
+	maxIdle time.Duration
+	dial    func() (net.Conn, *remoteServer, error)
+
+	mu    sync.Mutex
+	conns []pooledConn
+
+	fillNotify chan struct{}
+}
+
+type pooledConn struct {
+	c       net.Conn
+	s       *remoteServer // nil in tests
+	created time.Time
+}
+
+func newConnPool(size int, maxIdle time.Duration, dial func() (net.Conn, *remoteServer, error)) *connPool {
+	return &connPool{
+		size:       size,
+		maxIdle:    maxIdle,
+		dial:       dial,
+		fillNotify: make(chan struct{}, 1),
+	}
+}
+
+// get returns an idle connection, or nil if there is no one. Connections
+// are counted as active connections of their server from now on.
+func (p *connPool) get() net.Conn {
+	defer p.notifyFill()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.conns) > 0 {
+		pc := p.conns[0]
+		p.conns = p.conns[1:]
+		if time.Since(pc.created) < p.maxIdle {
+			if pc.s == nil {
+				return pc.c
+			}
+			return pc.s.trackConn(pc.c)
+		}
+		pc.c.Close()
+	}
+	return nil
+}
+
+func (p *connPool) notifyFill() {
+	select {
+	case p.fillNotify <- struct{}{}:
+	default:
+	}
+}
+
+// removeExpired closes expired connections and returns the
+// number of connections left.
+func (p *connPool) removeExpired() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.conns[:0]
+	for _, pc := range p.conns {
+		if time.Since(pc.created) < p.maxIdle {
+			conns = append(conns, pc)
+		} else {
+			pc.c.Close()
+		}
+	}
+	for i := len(conns); i < len(p.conns); i++ {
+		p.conns[i] = pooledConn{}
+	}
+	p.conns = conns
+	return len(p.conns)
+}
+
+func (p *connPool) put(c net.Conn, s *remoteServer) {
+	p.mu.Lock()
+	p.conns = append(p.conns, pooledConn{c: c, s: s, created: time.Now()})
+	p.mu.Unlock()
+}
+
+// keepAlive sends a keepalive dst header on every idle connection.
+// Connections that failed will be closed.
+func (p *connPool) keepAlive() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+
+	alive := make([]pooledConn, 0, len(conns))
+	for _, pc := range conns {
+		pc.c.SetWriteDeadline(time.Now().Add(defaultHandShakeTimeout))
+		err := writeDstHeader(pc.c, dstHeaderCmdKeepAlive, "")
+		pc.c.SetWriteDeadline(time.Time{})
+		if err != nil {
+			pc.c.Close()
+			continue
+		}
+		alive = append(alive, pc)
+	}
+
+	p.mu.Lock()
+	p.conns = append(alive, p.conns...)
+	p.mu.Unlock()
+}
+
+// fill tops up the pool in the background until closeNotify is closed.
+func (p *connPool) fill(closeNotify <-chan struct{}, onDialErr func(error)) {
+	ticker := time.NewTicker(p.maxIdle / 2)
+	defer ticker.Stop()
+	keepAliveTicker := time.NewTicker(connPoolKeepAliveInterval)
+	defer keepAliveTicker.Stop()
+	defer p.closeAll()
+
+	for {
+		for n := p.removeExpired(); n < p.size; n++ {
+			c, s, err := p.dial()
+			if err != nil {
+				onDialErr(err)
+				select {
+				case <-time.After(connPoolRetryInterval):
+				case <-closeNotify:
+					return
+				}
+				break
+			}
+			p.put(c, s)
+		}
+
+		select {
+		case <-p.fillNotify:
+		case <-ticker.C:
+		case <-keepAliveTicker.C:
+			p.keepAlive()
+		case <-closeNotify:
+			return
+		}
+	}
+}
+
+func (p *connPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.conns {
+		pc.c.Close()
+	}
+	p.conns = nil
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func Test_connPool(t *testing.T) {
+	dialed := 0
+	p := newConnPool(2, time.Minute, func() (net.Conn, *remoteServer, error) {
+		dialed++
+		c, _ := net.Pipe()
+		return c, nil, nil
+	})
+
+	if c := p.get(); c != nil {
+		t.Fatal("empty pool returned a conn")
+	}
+
+	closeNotify := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		p.fill(closeNotify, func(err error) { t.Error(err) })
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := p.removeExpired(); n != 2 {
+		t.Fatalf("want 2 pooled conns, got %d", n)
+	}
+
+	if c := p.get(); c == nil {
+		t.Fatal("pool returned nil")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := p.removeExpired(); n != 2 {
+		t.Fatalf("pool was not refilled, got %d", n)
+	}
+	if dialed != 3 {
+		t.Fatalf("want 3 dials, got %d", dialed)
+	}
+
+	close(closeNotify)
+	<-done
+	if n := p.removeExpired(); n != 0 {
+		t.Fatalf("pool was not emptied after close, got %d", n)
+	}
+}
+
+func Test_connPool_expired(t *testing.T) {
+	p := newConnPool(1, time.Minute, nil)
+	c, _ := net.Pipe()
+	p.put(c, nil)
+	p.conns[0].created = time.Now().Add(-2 * time.Minute)
+	if c := p.get(); c != nil {
+		t.Fatal("pool returned an expired conn")
+	}
+}
+
+func Test_connPool_keepAlive(t *testing.T) {
+	p := newConnPool(2, time.Minute, nil)
+	alive, aliveServer := net.Pipe()
+	defer aliveServer.Close()
+	dead, deadServer := net.Pipe()
+	deadServer.Close()
+	p.put(alive, nil)
+	p.put(dead, nil)
+
+	go p.keepAlive()
+	aliveServer.SetReadDeadline(time.Now().Add(time.Second))
+	cmd, dst, err := readDstHeader(aliveServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != dstHeaderCmdKeepAlive || len(dst) != 0 {
+		t.Fatalf("want keepalive header, got cmd %d dst [%s]", cmd, dst)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := p.removeExpired(); n != 1 {
+		t.Fatalf("failed conn should be removed, got %d conns", n)
+	}
+}
+
+func Test_connPool_activeConns(t *testing.T) {
+	s := new(remoteServer)
+	p := newConnPool(1, time.Minute, nil)
+	c, _ := net.Pipe()
+	p.put(c, s)
+	if n := atomic.LoadInt32(&s.activeConns); n != 0 {
+		t.Fatalf("idle pooled conns should not be active, got %d", n)
+	}
+	pc := p.get()
+	if n := atomic.LoadInt32(&s.activeConns); n != 1 {
+		t.Fatalf("want 1 active conn, got %d", n)
+	}
+	pc.Close()
+	if n := atomic.LoadInt32(&s.activeConns); n != 0 {
+		t.Fatalf("want 0 active conn, got %d", n)
+	}
+}
+
+func Test_Server_skipKeepAlive(t *testing.T) {
+	dstConn, dstServer := net.Pipe()
+	defer dstServer.Close()
+	server := &Server{
+		conf:         &ServerConfig{EnableDstHeader: true, Timeout: time.Second},
+		dstAllowList: new(dstAllowList),
+		testDialDst:  func() (net.Conn, error) { return dstConn, nil },
+	}
+
+	client, leftConn := net.Pipe()
+	defer client.Close()
+	go server.handleClientConn(leftConn, "127.0.0.1:1", logrus.NewEntry(logrus.StandardLogger()))
+
+	client.SetDeadline(time.Now().Add(time.Second * 2))
+	for _, cmd := range []byte{dstHeaderCmdKeepAlive, dstHeaderCmdKeepAlive, dstHeaderCmdConnect} {
+		if err := writeDstHeader(client, cmd, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	dstServer.SetReadDeadline(time.Now().Add(time.Second * 2))
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(dstServer, b); err != nil || string(b) != "hi" {
+		t.Fatalf("want hi, got %s, %v", b, err)
+	}
+}
+
+func Test_NewClient_connPoolMaxIdle(t *testing.T) {
+	c := &ClientConfig{BindAddr: clientBindAddr, RemoteAddr: serverBindAddr, Timeout: time.Second, EnableDstHeader: true, ConnPoolSize: 1, ConnPoolMaxIdle: time.Nanosecond}
+	if _, err := NewClient(c); err == nil {
+		t.Fatal("tiny conn pool max idle should fail")
+	}
+}
@@ -120,7 +120,7 @@ func test(sc *ServerConfig, cc *ClientConfig, t *testing.T) {
 
 	wg := sync.WaitGroup{}
 
-	client, err := NewClient(clientTestConfig)
+	client, err := NewClient(cc)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -133,7 +133,7 @@ func test(sc *ServerConfig, cc *ClientConfig, t *testing.T) {
 	// }()
 	// defer client.Close()
 
-	server, err := NewServer(serverTestConfig)
+	server, err := NewServer(sc)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -252,14 +252,14 @@ func bench(sc *ServerConfig, cc *ClientConfig, b *testing.B) (conn net.Conn) {
 
 	wg := sync.WaitGroup{}
 
-	client, err := NewClient(clientTestConfig)
+	client, err := NewClient(cc)
 	if err != nil {
 		b.Fatal(err)
 	}
 	client.testDialServerRaw = dummyConnL2C.connect
 
 	// server
-	server, err := NewServer(serverTestConfig)
+	server, err := NewServer(sc)
 	if err != nil {
 		b.Fatal(err)
 	}
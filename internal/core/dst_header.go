@@ -0,0 +1,279 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// destination header, it is sent by client at the beginning of every
+// tunnel stream if dst header is enabled.
+//
+//	+-----+-----+------+----------+----------+
+//	| VER | CMD | ATYP | DST.ADDR | DST.PORT |
+//	+-----+-----+------+----------+----------+
+//	|  1  |  1  |  1   | Variable |    2     |
+//	+-----+-----+------+----------+----------+
+//
+// ATYP and DST.ADDR are the same as socks5, except that ATYP 0 means
+// using the server's default destination, and DST.ADDR, DST.PORT are omitted.
+const (
+	dstHeaderVersion = 1
+
+	dstHeaderCmdConnect = 1
+	dstHeaderCmdUDP     = 3
+	// keepalive headers are sent by idle pooled connections, server
+	// ignores them and reads the next header.
+	dstHeaderCmdKeepAlive = 0x7f
+
+	dstHeaderAtypDefault = 0
+	dstHeaderAtypIPv4    = 1
+	dstHeaderAtypDomain  = 3
+	dstHeaderAtypIPv6    = 4
+)
+
+// writeDstHeader writes a dst header to w. An empty dst means using
+// the server's default destination.
+func writeDstHeader(w io.Writer, cmd byte, dst string) error {
+	b := []byte{dstHeaderVersion, cmd}
+	if len(dst) == 0 {
+		b = append(b, dstHeaderAtypDefault)
+	} else {
+		addr, err := appendSocksAddr(b, dst)
+		if err != nil {
+			return err
+		}
+		b = addr
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readDstHeader reads a dst header from r. An empty dst means using
+// the server's default destination. Keepalive headers are returned too.
+func readDstHeader(r io.Reader) (cmd byte, dst string, err error) {
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, "", err
+	}
+	if b[0] != dstHeaderVersion {
+		return 0, "", fmt.Errorf("invalid dst header version %d", b[0])
+	}
+	if b[2] == dstHeaderAtypDefault {
+		return b[1], "", nil
+	}
+	dst, err = readSocksAddr(r, b[2])
+	return b[1], dst, err
+}
+
+// appendSocksAddr appends ATYP, DST.ADDR and DST.PORT of addr to b.
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port [%s]", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, dstHeaderAtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, dstHeaderAtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name [%s] is too long", host)
+		}
+		b = append(b, dstHeaderAtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// readSocksAddr reads DST.ADDR and DST.PORT of atyp from r.
+func readSocksAddr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case dstHeaderAtypIPv4, dstHeaderAtypIPv6:
+		ipLen := net.IPv4len
+		if atyp == dstHeaderAtypIPv6 {
+			ipLen = net.IPv6len
+		}
+		ip := make([]byte, ipLen)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case dstHeaderAtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return "", err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("invalid address type %d", atyp)
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// dstAllowList checks whether a destination is allowed.
+type dstAllowList struct {
+	rules []dstAllowRule
+}
+
+type dstAllowRule struct {
+	domain string // exact domain, or suffix if it starts with "."
+	ipNet  *net.IPNet
+	port   string // empty means any port
+}
+
+// newDstAllowList parses a list of rules separated by ','. A rule can be a
+// domain, a wildcard domain ("*.example.com"), an IP or a CIDR, optionally
+// followed by a port, e.g. "example.com:443", "[fd00::/8]:22".
+func newDstAllowList(s string) (*dstAllowList, error) {
+	l := new(dstAllowList)
+	for _, str := range strings.Split(s, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+
+		rule := dstAllowRule{}
+		host := str
+		if h, p, err := net.SplitHostPort(str); err == nil {
+			host, rule.port = h, p
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			rule.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if _, ipNet, err := net.ParseCIDR(host); err == nil {
+			rule.ipNet = ipNet
+		} else if strings.HasPrefix(host, "*.") {
+			rule.domain = strings.ToLower(host[1:])
+		} else if len(host) != 0 && !strings.ContainsAny(host, "*/") {
+			rule.domain = strings.ToLower(host)
+		} else {
+			return nil, fmt.Errorf("invalid rule [%s]", str)
+		}
+		l.rules = append(l.rules, rule)
+	}
+	return l, nil
+}
+
+func (l *dstAllowList) len() int {
+	return len(l.rules)
+}
+
+// allow reports whether dst is allowed. If l is empty, all destinations
+// except internal addresses are allowed. Internal addresses (loopback,
+// private, link-local, unspecified) are only allowed if they are listed.
+func (l *dstAllowList) allow(dst string) bool {
+	if l.listed(dst) {
+		return true
+	}
+	if len(l.rules) != 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(dst)
+	if err != nil {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return !isInternalIP(ip)
+	}
+	// domains are checked again after they are resolved, see denyInternalAddr
+	return true
+}
+
+// listed reports whether dst matches a rule of l.
+func (l *dstAllowList) listed(dst string) bool {
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	host = strings.ToLower(host)
+
+	for _, rule := range l.rules {
+		if len(rule.port) != 0 && rule.port != port {
+			continue
+		}
+		switch {
+		case rule.ipNet != nil:
+			if ip != nil && rule.ipNet.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(rule.domain, "."):
+			if ip == nil && strings.HasSuffix(host, rule.domain) {
+				return true
+			}
+		default:
+			if ip == nil && host == rule.domain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var errInternalDst = errors.New("internal address is not allowed")
+
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// denyInternalAddr is a net.Dialer Control function. It stops domains that
+// are resolved to internal addresses from being dialed.
+func denyInternalAddr(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && isInternalIP(ip) {
+		return errInternalDst
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_dstHeader(t *testing.T) {
+	for _, dst := range []string{"", "127.0.0.1:80", "[::1]:443", "example.com:8080"} {
+		buf := new(bytes.Buffer)
+		if err := writeDstHeader(buf, dstHeaderCmdConnect, dst); err != nil {
+			t.Fatal(err)
+		}
+		cmd, got, err := readDstHeader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd != dstHeaderCmdConnect || got != dst {
+			t.Fatalf("want cmd %d dst [%s], got cmd %d dst [%s]", dstHeaderCmdConnect, dst, cmd, got)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%d bytes left in buf", buf.Len())
+		}
+	}
+
+	if _, _, err := readDstHeader(bytes.NewReader([]byte{0xff, dstHeaderCmdConnect, dstHeaderAtypDefault})); err == nil {
+		t.Fatal("err is expected")
+	}
+}
+
+func Test_dstAllowList(t *testing.T) {
+	l, err := newDstAllowList("example.com, *.example.org:443, 10.0.0.0/8, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dst   string
+		allow bool
+	}{
+		{"example.com:80", true},
+		{"EXAMPLE.com:80", true},
+		{"a.example.com:80", false},
+		{"a.example.org:443", true},
+		{"a.example.org:80", false},
+		{"example.org:443", false},
+		{"10.1.2.3:22", true},
+		{"11.1.2.3:22", false},
+		{"[::1]:53", true},
+		{"[::2]:53", false},
+	}
+	for _, tt := range tests {
+		if got := l.allow(tt.dst); got != tt.allow {
+			t.Errorf("allow(%s) = %v, want %v", tt.dst, got, tt.allow)
+		}
+	}
+
+	empty, err := newDstAllowList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dst, allow := range map[string]bool{
+		"example.com:80": true,
+		"1.1.1.1:53":     true,
+		"127.0.0.1:80":   false,
+		"192.168.1.1:80": false,
+		"169.254.1.1:80": false,
+		"[::1]:80":       false,
+		"[fe80::1]:80":   false,
+		"0.0.0.0:80":     false,
+		"no port":        false,
+	} {
+		if got := empty.allow(dst); got != allow {
+			t.Errorf("empty list: allow(%s) = %v, want %v", dst, got, allow)
+		}
+	}
+
+	// internal addresses can be listed explicitly
+	if !l.allow("10.1.2.3:80") || l.allow("192.168.1.1:80") {
+		t.Error("only listed internal addresses should be allowed")
+	}
+
+	if _, err := newDstAllowList("a*b.com"); err == nil {
+		t.Fatal("err is expected")
+	}
+}
+
+func Test_socks5Handshake(t *testing.T) {
+	for _, auth := range []bool{false, true} {
+		user, pass := "", ""
+		if auth {
+			user, pass = "user", "pass"
+		}
+
+		local, inbound := net.Pipe()
+		errChan := make(chan error, 1)
+		go func() {
+			defer local.Close()
+			if auth {
+				local.Write([]byte{socks5Version, 1, socks5MethodUserPass})
+			} else {
+				local.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+			}
+			b := make([]byte, 10)
+			if _, err := io.ReadFull(local, b[:2]); err != nil {
+				errChan <- err
+				return
+			}
+			if auth {
+				local.Write([]byte{socks5UserPassVersion, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'})
+				if _, err := io.ReadFull(local, b[:2]); err != nil {
+					errChan <- err
+					return
+				}
+			}
+			req := []byte{socks5Version, socks5CmdConnect, 0}
+			req, _ = appendSocksAddr(req, "example.com:443")
+			_, err := local.Write(req)
+			errChan <- err
+		}()
+
+		dst, err := socks5Handshake(inbound, user, pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errChan; err != nil {
+			t.Fatal(err)
+		}
+		if dst != "example.com:443" {
+			t.Fatalf("want dst example.com:443, got %s", dst)
+		}
+		inbound.Close()
+	}
+}
+
+func Test_Server_dialDst_internal(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	server := &Server{netDialer: &net.Dialer{Timeout: time.Second}}
+	if _, err := server.dialDst("tcp", net.JoinHostPort("localhost", port), true); err == nil {
+		t.Fatal("domain resolved to an internal address should not be dialed")
+	}
+	c, err := server.dialDst("tcp", net.JoinHostPort("localhost", port), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// newFallbackHandler returns a reverse proxy if s is a http(s) URL,
+// or a static file server if s is a directory.
+func newFallbackHandler(s string) (http.Handler, error) {
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		p := httputil.NewSingleHostReverseProxy(u)
+		director := p.Director
+		p.Director = func(r *http.Request) {
+			director(r)
+			r.Host = u.Host
+		}
+		return p, nil
+	}
+
+	fi, err := os.Stat(s)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory or a http(s) URL", s)
+	}
+	return http.FileServer(http.Dir(s)), nil
+}
+
+// clientAuthed reports whether the client sent a verified certificate,
+// if client certificates are requested.
+func (server *Server) clientAuthed(state *tls.ConnectionState) bool {
+	if len(server.conf.ClientCA) == 0 {
+		return true
+	}
+	return state != nil && len(state.VerifiedChains) != 0
+}
+
+// isTunnelRequest reports whether r should be handled by the tunnel
+// instead of the fallback.
+func (server *Server) isTunnelRequest(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r) && server.clientAuthed(r.TLS)
+}
+
+// isTunnelConn reports whether a raw connection is a tunnel connection.
+// If psk is set, it reads the psk preamble. Otherwise, it peeks the first
+// byte. If neither dst header nor mux is enabled, the tunnel data can be
+// anything, only client certificates are checked. alpn is the negotiated
+// protocol, it tells whether client enabled mux.
+func (server *Server) isTunnelConn(c *bufferedConn, alpn string, requestEntry *logrus.Entry) bool {
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		if !server.clientAuthed(&state) {
+			requestEntry.Warn("no client certificate")
+			return false
+		}
+	}
+	if server.pskVerifier != nil {
+		if err := server.pskVerifier.readPSKPreamble(c); err != nil {
+			requestEntry.Warnf("psk: %v", err)
+			return false
+		}
+		return true
+	}
+	enableMux := server.conf.EnableMux
+	switch alpn {
+	case websocketSubprotocolSmuxON, websocketSubprotocolYamux:
+		enableMux = true
+	case websocketSubprotocolSmuxOFF:
+		enableMux = false
+	}
+	if !server.conf.EnableDstHeader && !enableMux {
+		return true
+	}
+
+	c.SetReadDeadline(time.Now().Add(server.conf.Timeout))
+	b, err := c.r.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		return true // let the tunnel handle the error
+	}
+	if enableMux {
+		return b[0] == byte(server.muxer.smuxConfig.Version) || b[0] == yamuxVersion
+	}
+	return b[0] == dstHeaderVersion
+}
+
+var errFallbackListenerClosed = errors.New("fallback listener closed")
+
+// fallbackListener is a net.Listener that accepts connections from serve.
+type fallbackListener struct {
+	addr      net.Addr
+	c         chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFallbackListener(addr net.Addr) *fallbackListener {
+	return &fallbackListener{addr: addr, c: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// serve passes c to the http server and blocks until c is closed.
+func (l *fallbackListener) serve(c net.Conn) {
+	nc := &notifyCloseConn{Conn: c, closed: make(chan struct{})}
+	select {
+	case l.c <- nc:
+		<-nc.closed
+	case <-l.closed:
+	}
+}
+
+// pass passes c to the http server, which will close c.
+func (l *fallbackListener) pass(c net.Conn) {
+	select {
+	case l.c <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+func (l *fallbackListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.c:
+		return c, nil
+	case <-l.closed:
+		return nil, errFallbackListenerClosed
+	}
+}
+
+func (l *fallbackListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *fallbackListener) Addr() net.Addr {
+	return l.addr
+}
+
+type notifyCloseConn struct {
+	net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *notifyCloseConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
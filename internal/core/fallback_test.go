@@ -0,0 +1,144 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const fallbackTestBody = "hello from decoy"
+
+func Test_newFallbackHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "index.html")
+	if err := ioutil.WriteFile(file, []byte(fallbackTestBody), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := newFallbackHandler(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Body.String() != fallbackTestBody {
+		t.Fatalf("want %q, got %q", fallbackTestBody, w.Body.String())
+	}
+
+	if _, err := newFallbackHandler("http://127.0.0.1:8080/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newFallbackHandler(file); err == nil {
+		t.Fatal("a file should not be a valid fallback")
+	}
+}
+
+func Test_fallback(t *testing.T) {
+	decoy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fallbackTestBody))
+	}))
+	defer decoy.Close()
+
+	tests := []struct {
+		name string
+		conf *ServerConfig
+		path string
+	}{
+		{"raw dst header", &ServerConfig{EnableDstHeader: true}, "/"},
+		{"raw mux", &ServerConfig{DstAddr: dstAddr, EnableMux: true}, "/"},
+		{"raw psk", &ServerConfig{DstAddr: dstAddr, PSK: "secret"}, "/"},
+		{"wss non-websocket", &ServerConfig{DstAddr: dstAddr, EnableWSS: true, WSSPath: "/"}, "/"},
+		{"wss wrong path", &ServerConfig{DstAddr: dstAddr, EnableWSS: true, WSSPath: "/ws"}, "/index.html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.BindAddr = serverBindAddr
+			tt.conf.Timeout = time.Second * 30
+			tt.conf.Fallback = decoy.URL
+			server, err := NewServer(tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := newDummyDialerListener()
+			go server.ActiveAndServe(l)
+			defer server.Close()
+
+			raw, err := l.connect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(time.Second * 5))
+
+			req, _ := http.NewRequest("GET", "https://mtt.test"+tt.path, nil)
+			if err := req.Write(c); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(c), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != fallbackTestBody {
+				t.Fatalf("want %q, got %q", fallbackTestBody, b)
+			}
+		})
+	}
+}
+
+func Test_fallback_tunnel(t *testing.T) {
+	decoy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fallbackTestBody))
+	}))
+	defer decoy.Close()
+
+	// tunnel connections should not be affected by fallback
+	serverTestConfig.Fallback = decoy.URL
+	defer func() { serverTestConfig.Fallback = "" }()
+
+	serverTestConfig.EnableWSS = false
+	serverTestConfig.EnableMux = true
+	clientTestConfig.EnableWSS = false
+	clientTestConfig.EnableMux = true
+	test(serverTestConfig, clientTestConfig, t)
+
+	serverTestConfig.EnableWSS = true
+	serverTestConfig.WSSPath = "/"
+	clientTestConfig.EnableWSS = true
+	clientTestConfig.WSSPath = "/"
+	test(serverTestConfig, clientTestConfig, t)
+}
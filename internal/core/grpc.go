@@ -0,0 +1,364 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// grpc transport carries a tunnel connection as a bidirectional gRPC
+// stream. Every message is a protobuf message with the data in field 1:
+//
+//	message Hunk {
+//	  bytes data = 1;
+//	}
+//
+// and the rpc is `rpc Tun (stream Hunk) returns (stream Hunk)`.
+const (
+	defaultGRPCServiceName = "mtt.Tunnel"
+	grpcContentType        = "application/grpc"
+
+	// max data size in one message
+	grpcMaxDataSize = defaultCopyIOBufferSize
+	// protobuf tag of field 1, wire type 2 (length-delimited)
+	grpcHunkDataTag = 0x0a
+)
+
+var errGRPCInvalidMessage = errors.New("invalid grpc message")
+
+func grpcPath(serviceName string) string {
+	return "/" + serviceName + "/Tun"
+}
+
+func isGRPCRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.ProtoMajor == 2 &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), grpcContentType)
+}
+
+// grpcWriter writes b as gRPC messages to w.
+type grpcWriter struct {
+	w     io.Writer
+	flush func()
+}
+
+func (gw *grpcWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		data := b
+		if len(data) > grpcMaxDataSize {
+			data = data[:grpcMaxDataSize]
+		}
+
+		// gRPC header(5) + protobuf tag(1) + varint(max 3) + data
+		buf := make([]byte, 9, 9+len(data))
+		buf[5] = grpcHunkDataTag
+		l := binary.PutUvarint(buf[6:], uint64(len(data)))
+		buf = buf[:6+l]
+		buf[0] = 0 // not compressed
+		binary.BigEndian.PutUint32(buf[1:5], uint32(1+l+len(data)))
+		buf = append(buf, data...)
+
+		if _, err := gw.w.Write(buf); err != nil {
+			return n, err
+		}
+		if gw.flush != nil {
+			gw.flush()
+		}
+		n += len(data)
+		b = b[len(data):]
+	}
+	return n, nil
+}
+
+// grpcReader reads data from gRPC messages in r.
+type grpcReader struct {
+	r    io.Reader
+	left int // data left in the current message
+}
+
+func (gr *grpcReader) Read(b []byte) (int, error) {
+	for gr.left == 0 {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(gr.r, header); err != nil {
+			return 0, err
+		}
+		if header[0] != 0 {
+			return 0, errors.New("compressed grpc message is not supported")
+		}
+		msgLen := int(binary.BigEndian.Uint32(header[1:]))
+		if msgLen == 0 { // empty message
+			continue
+		}
+
+		// protobuf tag and data length
+		tag := make([]byte, 1)
+		if _, err := io.ReadFull(gr.r, tag); err != nil {
+			return 0, err
+		}
+		if tag[0] != grpcHunkDataTag {
+			return 0, errGRPCInvalidMessage
+		}
+		dataLen, err := binary.ReadUvarint(byteReader{gr.r})
+		if err != nil {
+			return 0, err
+		}
+		if int(dataLen) != msgLen-1-uvarintLen(dataLen) {
+			return 0, errGRPCInvalidMessage
+		}
+		gr.left = int(dataLen)
+	}
+
+	if len(b) > gr.left {
+		b = b[:gr.left]
+	}
+	n, err := gr.r.Read(b)
+	gr.left -= n
+	if err == io.EOF && gr.left != 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func uvarintLen(x uint64) int {
+	return binary.PutUvarint(make([]byte, binary.MaxVarintLen64), x)
+}
+
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(r, b)
+	return b[0], err
+}
+
+// grpcClientConn is a gRPC stream opened by client. There is no way to
+// interrupt a blocked read or write of a http2 stream, so the stream will
+// be closed if any of its deadlines is exceeded.
+type grpcClientConn struct {
+	grpcReader
+	grpcWriter
+
+	body   io.Closer
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+
+	localAddr, remoteAddr net.Addr
+
+	readDeadline, writeDeadline deadlineTimer
+	closeOnce                   sync.Once
+}
+
+func (client *Client) dialGRPC(s *remoteServer) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &grpcClientConn{cancel: cancel, localAddr: httpAddr(""), remoteAddr: httpAddr(s.addr)}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.localAddr, c.remoteAddr = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+		},
+	})
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.grpcURL, pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", grpcContentType)
+	req.Header.Set("TE", "trailers")
+
+	// server sends response header without waiting for client's data
+	timer := time.AfterFunc(defaultHandShakeTimeout, cancel)
+	resp, err := s.httpTransport.RoundTrip(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+
+	c.grpcReader = grpcReader{r: resp.Body}
+	c.grpcWriter = grpcWriter{w: pw}
+	c.body = resp.Body
+	c.pw = pw
+	c.readDeadline.f = func() { c.Close() }
+	c.writeDeadline.f = func() { c.Close() }
+	return c, nil
+}
+
+func (c *grpcClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.readDeadline.set(time.Time{})
+		c.writeDeadline.set(time.Time{})
+		c.pw.Close()
+		c.body.Close()
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *grpcClientConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *grpcClientConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *grpcClientConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *grpcClientConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *grpcClientConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// grpcServerConn is a gRPC stream accepted by server.
+type grpcServerConn struct {
+	grpcReader
+	grpcWriter
+
+	rc *http.ResponseController
+	r  *http.Request
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newGRPCServerConn sends the response header and returns a net.Conn
+// of the stream. The stream ends when the handler returns.
+func newGRPCServerConn(w http.ResponseWriter, r *http.Request) (*grpcServerConn, error) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+
+	c := &grpcServerConn{rc: rc, r: r, closed: make(chan struct{})}
+	c.grpcReader = grpcReader{r: r.Body}
+	c.grpcWriter = grpcWriter{w: w, flush: func() { rc.Flush() }}
+	return c, nil
+}
+
+// finish sends the grpc status trailer.
+func (c *grpcServerConn) finish(w http.ResponseWriter) {
+	c.Close()
+	w.Header().Set("Grpc-Status", "0")
+}
+
+func (c *grpcServerConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	n, err := c.grpcReader.Read(b)
+	if err != nil && c.r.Context().Err() != nil {
+		// client closed the stream
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *grpcServerConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return c.grpcWriter.Write(b)
+}
+
+func (c *grpcServerConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		// interrupt blocked read and write
+		c.rc.SetReadDeadline(longTimeAgo)
+		c.rc.SetWriteDeadline(longTimeAgo)
+	})
+	return nil
+}
+
+func (c *grpcServerConn) LocalAddr() net.Addr {
+	if addr, ok := c.r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return httpAddr("")
+}
+
+func (c *grpcServerConn) RemoteAddr() net.Addr { return httpAddr(c.r.RemoteAddr) }
+
+func (c *grpcServerConn) SetDeadline(t time.Time) error {
+	c.rc.SetReadDeadline(t)
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *grpcServerConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+func (c *grpcServerConn) SetWriteDeadline(t time.Time) error {
+	return c.rc.SetWriteDeadline(t)
+}
+
+// serveGRPC handles gRPC streams from clients.
+func (server *Server) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	requestEntry := logrus.WithField("grpc_client", r.RemoteAddr)
+	requestEntry.Debug("grpc stream accepted")
+	if !isGRPCRequest(r) || !server.clientAuthed(r.TLS) {
+		if server.fallback != nil {
+			requestEntry.Debug("not a tunnel request, fallback")
+			server.fallback.ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	leftConn, err := newGRPCServerConn(w, r)
+	if err != nil {
+		requestEntry.Errorf("grpc response, %v", err)
+		return
+	}
+	defer leftConn.finish(w)
+	server.handleClientConn(leftConn, server.routeDst(r.TLS), requestEntry)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func Test_grpcReaderWriter(t *testing.T) {
+	for _, size := range []int{1, 127, 128, grpcMaxDataSize, grpcMaxDataSize*3 + 1} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		buf := new(bytes.Buffer)
+		w := &grpcWriter{w: buf}
+		if n, err := w.Write(data); err != nil || n != size {
+			t.Fatalf("size %d: write n = %d, err = %v", size, n, err)
+		}
+
+		got, err := ioutil.ReadAll(&grpcReader{r: buf})
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: data err", size)
+		}
+	}
+}
+
+func Test_grpcReader_invalid(t *testing.T) {
+	// a message with protobuf field 2
+	b := []byte{0, 0, 0, 0, 3, 0x12, 1, 'a'}
+	if _, err := (&grpcReader{r: bytes.NewReader(b)}).Read(make([]byte, 8)); err != errGRPCInvalidMessage {
+		t.Fatalf("want errGRPCInvalidMessage, got %v", err)
+	}
+
+	// truncated message
+	b = []byte{0, 0, 0, 0, 3, 0x0a, 2, 'a'}
+	if _, err := ioutil.ReadAll(&grpcReader{r: bytes.NewReader(b)}); err != errGRPCInvalidMessage {
+		t.Fatalf("want errGRPCInvalidMessage, got %v", err)
+	}
+
+	b = []byte{0, 0, 0, 0, 4, 0x0a, 2, 'a'}
+	if _, err := ioutil.ReadAll(&grpcReader{r: bytes.NewReader(b)}); err != io.ErrUnexpectedEOF {
+		t.Fatalf("want io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func Test_grpc(t *testing.T) {
+	serverTestConfig.EnableWSS = false
+	serverTestConfig.EnableMux = false
+	serverTestConfig.EnableGRPC = true
+	clientTestConfig.EnableWSS = false
+	clientTestConfig.EnableMux = false
+	clientTestConfig.EnableGRPC = true
+	defer func() {
+		serverTestConfig.EnableGRPC = false
+		clientTestConfig.EnableGRPC = false
+	}()
+	test(serverTestConfig, clientTestConfig, t)
+
+	// wss and grpc on the same server
+	serverTestConfig.EnableWSS = true
+	serverTestConfig.WSSPath = "/"
+	test(serverTestConfig, clientTestConfig, t)
+
+	clientTestConfig.EnableGRPC = false
+	clientTestConfig.EnableWSS = true
+	clientTestConfig.WSSPath = "/"
+	test(serverTestConfig, clientTestConfig, t)
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// weight of the newest probe result in rtt and success rate
+	healthCheckEWMAWeight = 0.3
+	// addresses below this success rate are considered unhealthy
+	healthySuccessRate = 0.8
+)
+
+//ServerStat is the health check result of a server address
+type ServerStat struct {
+	Server      string // server address from config
+	Addr        string // resolved address
+	RTT         time.Duration
+	SuccessRate float64
+	LastCheck   time.Time
+	LastErr     string
+}
+
+type addrStat struct {
+	rtt         time.Duration
+	successRate float64
+	lastCheck   time.Time
+	lastErr     error
+}
+
+func (s *addrStat) update(rtt time.Duration, err error) {
+	result := float64(1)
+	if err != nil {
+		result = 0
+	}
+
+	if s.lastCheck.IsZero() { // first probe
+		s.successRate = result
+		if err == nil {
+			s.rtt = rtt
+		}
+	} else {
+		s.successRate = s.successRate*(1-healthCheckEWMAWeight) + result*healthCheckEWMAWeight
+		if err == nil {
+			if s.rtt == 0 {
+				s.rtt = rtt
+			} else {
+				s.rtt = time.Duration(float64(s.rtt)*(1-healthCheckEWMAWeight) + float64(rtt)*healthCheckEWMAWeight)
+			}
+		}
+	}
+	s.lastCheck = time.Now()
+	s.lastErr = err
+}
+
+// addrStats holds the health check results of all resolved addresses of a server.
+type addrStats struct {
+	sync.Mutex
+	m map[string]*addrStat
+}
+
+// bestAddr returns the healthiest, lowest-latency address. If no address has
+// been probed, it returns "".
+func (as *addrStats) bestAddr() string {
+	as.Lock()
+	defer as.Unlock()
+
+	var best string
+	var bestStat *addrStat
+	for addr, s := range as.m {
+		if s.lastCheck.IsZero() {
+			continue
+		}
+		if bestStat == nil || betterAddrStat(s, bestStat) {
+			best, bestStat = addr, s
+		}
+	}
+	return best
+}
+
+func betterAddrStat(a, b *addrStat) bool {
+	aHealthy, bHealthy := a.successRate >= healthySuccessRate, b.successRate >= healthySuccessRate
+	switch {
+	case aHealthy && !bHealthy:
+		return true
+	case !aHealthy && bHealthy:
+		return false
+	case !aHealthy && !bHealthy:
+		return a.successRate > b.successRate
+	default:
+		return a.rtt < b.rtt
+	}
+}
+
+// healthCheck probes all servers every interval until client is closed.
+func (client *Client) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		wg := sync.WaitGroup{}
+		for _, s := range client.balancer.servers {
+			wg.Add(1)
+			go func(s *remoteServer) {
+				defer wg.Done()
+				client.probeServer(s)
+			}(s)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-client.closeNotify:
+			return
+		}
+	}
+}
+
+// probeServer resolves all addresses of s and probes them.
+// s will be taken out of rotation if all of its addresses failed.
+func (client *Client) probeServer(s *remoteServer) {
+	host, port, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		client.log.Errorf("health check: invalid server address %s: %v", s.addr, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHandShakeTimeout)
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	cancel()
+	if err != nil {
+		client.log.Warnf("health check: lookup %s: %v", host, err)
+		client.balancer.markFailed(s)
+		return
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+
+	type result struct {
+		addr string
+		rtt  time.Duration
+		err  error
+	}
+	results := make([]result, len(addrs))
+	wg := sync.WaitGroup{}
+	for i := range addrs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rtt, err := client.probeAddr(s, addrs[i])
+			results[i] = result{addr: addrs[i], rtt: rtt, err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	ok := false
+	s.addrStats.Lock()
+	m := make(map[string]*addrStat, len(results))
+	for _, r := range results {
+		as := s.addrStats.m[r.addr] // keep the history of addresses that are still valid
+		if as == nil {
+			as = new(addrStat)
+		}
+		as.update(r.rtt, r.err)
+		m[r.addr] = as
+
+		if r.err != nil {
+			client.log.Warnf("health check: server %s addr %s: %v", s.addr, r.addr, r.err)
+		} else {
+			ok = true
+			client.log.Debugf("health check: server %s addr %s: rtt %v", s.addr, r.addr, r.rtt)
+		}
+	}
+	s.addrStats.m = m
+	s.addrStats.Unlock()
+
+	if ok {
+		client.balancer.markOK(s)
+	} else {
+		client.balancer.markFailed(s)
+	}
+}
+
+// probeAddr does a TLS handshake (or a websocket upgrade if wss is enabled,
+// or a QUIC handshake if quic is enabled) with addr and returns the time it took.
+// In raw tls mode, the psk preamble is sent. If mux is enabled, a no-op
+// stream is opened to check the mux layer.
+func (client *Client) probeAddr(s *remoteServer, addr string) (time.Duration, error) {
+	start := time.Now()
+	if client.conf.EnableQUIC {
+		conn, err := client.dialQUICConn(s, addr)
+		if err != nil {
+			return 0, err
+		}
+		conn.CloseWithError(0, "")
+		return time.Since(start), nil
+	}
+
+	var conn net.Conn
+	if client.conf.EnableWSS {
+		d := *s.wsDialer
+		d.NetDial = func(network, _ string) (net.Conn, error) {
+			return client.netDialer.Dial(network, addr)
+		}
+		// server won't dial the destination before the first stream is opened
+		d.Subprotocols = []string{muxSubprotocol(true, client.conf.Muxer)}
+		c, err := dialWebsocketConn(&d, s.wssURL)
+		if err != nil {
+			return 0, err
+		}
+		conn = c
+	} else {
+		raw, err := client.netDialer.Dial("tcp", addr)
+		if err != nil {
+			return 0, err
+		}
+		c := tls.Client(raw, s.tlsConf)
+		c.SetDeadline(time.Now().Add(defaultHandShakeTimeout))
+		if err := c.Handshake(); err != nil {
+			c.Close()
+			return 0, err
+		}
+		if len(client.conf.PSK) != 0 && !client.conf.EnableSplitHTTP {
+			if err := writePSKPreamble(c, client.conf.PSK); err != nil {
+				c.Close()
+				return 0, err
+			}
+		}
+		conn = c
+	}
+	defer conn.Close()
+
+	if client.conf.EnableMux {
+		if err := client.probeMux(conn); err != nil {
+			return 0, fmt.Errorf("mux: %v", err)
+		}
+	}
+	return time.Since(start), nil
+}
+
+// probeMux opens and closes a no-op stream on a new mux session over conn.
+func (client *Client) probeMux(conn net.Conn) error {
+	sess, err := client.muxer.client(client.conf.Muxer, conn)
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+	stream, err := sess.OpenStream()
+	if err != nil {
+		return err
+	}
+	return stream.Close()
+}
+
+//ServerStats returns the health check results of all servers
+func (client *Client) ServerStats() []ServerStat {
+	stats := make([]ServerStat, 0)
+	for _, s := range client.balancer.servers {
+		s.addrStats.Lock()
+		for addr, as := range s.addrStats.m {
+			stat := ServerStat{
+				Server:      s.addr,
+				Addr:        addr,
+				RTT:         as.rtt,
+				SuccessRate: as.successRate,
+				LastCheck:   as.lastCheck,
+			}
+			if as.lastErr != nil {
+				stat.LastErr = as.lastErr.Error()
+			}
+			stats = append(stats, stat)
+		}
+		s.addrStats.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Server != stats[j].Server {
+			return stats[i].Server < stats[j].Server
+		}
+		return stats[i].Addr < stats[j].Addr
+	})
+	return stats
+}
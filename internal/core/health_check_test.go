@@ -0,0 +1,117 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_addrStats_bestAddr(t *testing.T) {
+	as := addrStats{m: map[string]*addrStat{
+		"1.1.1.1:443": new(addrStat),
+		"2.2.2.2:443": new(addrStat),
+		"3.3.3.3:443": new(addrStat),
+	}}
+	if addr := as.bestAddr(); addr != "" {
+		t.Fatalf("no address has been probed, got %s", addr)
+	}
+
+	as.m["1.1.1.1:443"].update(time.Millisecond*100, nil)
+	as.m["2.2.2.2:443"].update(time.Millisecond*50, nil)
+	as.m["3.3.3.3:443"].update(0, errors.New("probe failed"))
+	if addr := as.bestAddr(); addr != "2.2.2.2:443" {
+		t.Fatalf("want the lowest-latency address, got %s", addr)
+	}
+
+	// the lowest-latency address becomes unhealthy
+	as.m["2.2.2.2:443"].update(0, errors.New("probe failed"))
+	if addr := as.bestAddr(); addr != "1.1.1.1:443" {
+		t.Fatalf("want the healthiest address, got %s", addr)
+	}
+}
+
+func Test_Client_probeAddr(t *testing.T) {
+	cers, err := generateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: cers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := NewClient(&ClientConfig{
+		BindAddr:           "127.0.0.1:0",
+		RemoteAddr:         l.Addr().String(),
+		InsecureSkipVerify: true,
+		PSK:                "secret",
+		EnableMux:          true,
+		MuxMaxStream:       defaultSmuxMaxStream,
+		Timeout:            time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// server checks the preamble and accepts the no-op stream
+	errChan := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		defer c.Close()
+		bc := newBufferedConn(c)
+		if err := newPSKVerifier("secret").readPSKPreamble(bc); err != nil {
+			errChan <- err
+			return
+		}
+		sess, err := client.muxer.server(MuxerSmux, bc)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		defer sess.Close()
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		stream.Close()
+		errChan <- nil
+	}()
+
+	if _, err := client.probeAddr(client.balancer.servers[0], l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("server timeout")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hop-by-hop headers that shouldn't be forwarded to the destination
+var httpProxyHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// handleHTTPProxyConn handles a HTTP proxy connection. Both CONNECT
+// and plain requests with absolute-URI are supported. Plain requests
+// are sent with "Connection: close", so one connection only carries
+// one request. If HTTPProxyUser is set, Basic authentication is required.
+func (client *Client) handleHTTPProxyConn(c net.Conn) error {
+	bc := newBufferedConn(c)
+
+	c.SetReadDeadline(time.Now().Add(defaultHandShakeTimeout))
+	req, err := http.ReadRequest(bc.r)
+	if err != nil {
+		return fmt.Errorf("read http proxy request: %v", err)
+	}
+	c.SetReadDeadline(time.Time{})
+
+	if len(client.conf.HTTPProxyUser) != 0 && !httpProxyAuthed(req, client.conf.HTTPProxyUser, client.conf.HTTPProxyPass) {
+		writeHTTPProxyResponse(c, http.StatusProxyAuthRequired)
+		return errors.New("http proxy authentication failed")
+	}
+
+	var dst string
+	if req.Method == http.MethodConnect {
+		dst = hostWithDefaultPort(req.Host, "443")
+	} else {
+		if !req.URL.IsAbs() || len(req.URL.Host) == 0 {
+			writeHTTPProxyResponse(c, http.StatusBadRequest)
+			return fmt.Errorf("http proxy request %s is not absolute", req.URL)
+		}
+		if req.URL.Scheme != "http" {
+			writeHTTPProxyResponse(c, http.StatusBadRequest)
+			return fmt.Errorf("unsupported http proxy request scheme [%s]", req.URL.Scheme)
+		}
+		dst = hostWithDefaultPort(req.URL.Host, "80")
+	}
+
+	rightConn, err := client.openServerConn(dstHeaderCmdConnect, dst)
+	if err != nil {
+		writeHTTPProxyResponse(c, http.StatusBadGateway)
+		return err
+	}
+	defer rightConn.Close()
+
+	if req.Method == http.MethodConnect {
+		if _, err := c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			return fmt.Errorf("write http proxy response: %v", err)
+		}
+	} else {
+		for _, h := range httpProxyHopHeaders {
+			req.Header.Del(h)
+		}
+		req.Close = true
+		rightConn.SetWriteDeadline(time.Now().Add(client.conf.Timeout))
+		if err := req.Write(rightConn); err != nil {
+			return fmt.Errorf("write http proxy request: %v", err)
+		}
+	}
+
+	err = openTunnel(bc, rightConn, client.conf.Timeout)
+	if err != nil {
+		return fmt.Errorf("openTunnel: %v", err)
+	}
+	return nil
+}
+
+// httpProxyAuthed reports whether req has the Basic Proxy-Authorization
+// of user and pass.
+func httpProxyAuthed(req *http.Request, user, pass string) bool {
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	u, p, ok := strings.Cut(string(b), ":")
+	return ok && subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+}
+
+func writeHTTPProxyResponse(c net.Conn, code int) error {
+	var h string
+	if code == http.StatusProxyAuthRequired {
+		h = "Proxy-Authenticate: Basic realm=\"mtt-client\"\r\n"
+	}
+	_, err := fmt.Fprintf(c, "HTTP/1.1 %d %s\r\n%sConnection: close\r\n\r\n", code, http.StatusText(code), h)
+	return err
+}
+
+func hostWithDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
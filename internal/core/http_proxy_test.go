@@ -0,0 +1,203 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHTTPProxyClient returns a client whose server reads the dst header,
+// sends it to dstChan and passes the connection to handle.
+func newTestHTTPProxyClient(t *testing.T, user, pass string, dstChan chan<- string, handle func(net.Conn)) *Client {
+	cers, err := generateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(&ClientConfig{
+		HTTPProxyAddr:      "127.0.0.1:0",
+		HTTPProxyUser:      user,
+		HTTPProxyPass:      pass,
+		RemoteAddr:         "127.0.0.1:1",
+		InsecureSkipVerify: true,
+		MuxMaxStream:       defaultSmuxMaxStream,
+		Timeout:            time.Second * 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.testDialServerRaw = func() (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			c := tls.Server(c2, &tls.Config{Certificates: cers})
+			defer c.Close()
+			_, dst, err := readDstHeader(c)
+			if err != nil {
+				return
+			}
+			dstChan <- dst
+			handle(c)
+		}()
+		return c1, nil
+	}
+	return client
+}
+
+func Test_handleHTTPProxyConn_connect(t *testing.T) {
+	dstChan := make(chan string, 1)
+	client := newTestHTTPProxyClient(t, "", "", dstChan, func(c net.Conn) {
+		io.Copy(c, c) // echo
+	})
+
+	local, inbound := net.Pipe()
+	defer local.Close()
+	go client.handleHTTPProxyConn(inbound)
+	local.SetDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err := io.WriteString(local, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(local)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want 200, got %d", resp.StatusCode)
+	}
+	if dst := <-dstChan; dst != "example.com:443" {
+		t.Fatalf("want dst example.com:443, got %s", dst)
+	}
+
+	if _, err := io.WriteString(local, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("want echo ping, got %s, %v", buf, err)
+	}
+}
+
+func Test_handleHTTPProxyConn_get(t *testing.T) {
+	dstChan := make(chan string, 1)
+	reqChan := make(chan *http.Request, 1)
+	client := newTestHTTPProxyClient(t, "", "", dstChan, func(c net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			return
+		}
+		reqChan <- req
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+	})
+
+	local, inbound := net.Pipe()
+	defer local.Close()
+	go client.handleHTTPProxyConn(inbound)
+	local.SetDeadline(time.Now().Add(time.Second * 5))
+
+	req := "GET http://example.com/path?q=1 HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Proxy-Connection: keep-alive\r\n" +
+		"Proxy-Authorization: Basic dXNlcjpwYXNz\r\n" +
+		"Connection: keep-alive\r\n" +
+		"X-Test: 1\r\n\r\n"
+	if _, err := io.WriteString(local, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(local), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("want 200 ok, got %d %s", resp.StatusCode, body)
+	}
+
+	if dst := <-dstChan; dst != "example.com:80" {
+		t.Fatalf("want dst example.com:80, got %s", dst)
+	}
+	got := <-reqChan
+	if got.URL.Path != "/path" || got.URL.RawQuery != "q=1" || got.Host != "example.com" {
+		t.Fatalf("unexpected request %s %s", got.Host, got.URL)
+	}
+	for _, h := range []string{"Proxy-Connection", "Proxy-Authorization"} {
+		if len(got.Header.Get(h)) != 0 {
+			t.Errorf("hop-by-hop header %s is forwarded", h)
+		}
+	}
+	if !got.Close {
+		t.Error("request should be sent with Connection: close")
+	}
+	if got.Header.Get("X-Test") != "1" {
+		t.Error("end-to-end header is not forwarded")
+	}
+}
+
+func Test_handleHTTPProxyConn_auth(t *testing.T) {
+	dstChan := make(chan string, 1)
+	client := newTestHTTPProxyClient(t, "user", "pass", dstChan, func(c net.Conn) {
+		io.Copy(c, c)
+	})
+
+	tests := []struct {
+		auth     string
+		wantCode int
+	}{
+		{"", http.StatusProxyAuthRequired},
+		{"Proxy-Authorization: Basic dXNlcjp3cm9uZw==\r\n", http.StatusProxyAuthRequired}, // user:wrong
+		{"Proxy-Authorization: Bearer dXNlcjpwYXNz\r\n", http.StatusProxyAuthRequired},
+		{"Proxy-Authorization: Basic dXNlcjpwYXNz\r\n", http.StatusOK}, // user:pass
+	}
+	for _, tt := range tests {
+		local, inbound := net.Pipe()
+		errChan := make(chan error, 1)
+		go func() { errChan <- client.handleHTTPProxyConn(inbound) }()
+		local.SetDeadline(time.Now().Add(time.Second * 5))
+
+		if _, err := io.WriteString(local, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n"+tt.auth+"\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(local), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("%q: want %d, got %d", tt.auth, tt.wantCode, resp.StatusCode)
+		}
+		if tt.wantCode == http.StatusProxyAuthRequired {
+			if !strings.HasPrefix(resp.Header.Get("Proxy-Authenticate"), "Basic") {
+				t.Error("no Proxy-Authenticate header")
+			}
+			if err := <-errChan; err == nil {
+				t.Error("auth failure should return an error")
+			}
+		} else {
+			<-dstChan
+		}
+		local.Close()
+	}
+}
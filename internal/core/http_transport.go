@@ -0,0 +1,83 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// newHTTPTransport returns a http transport that dials s. If h2Only is
+// true, servers that don't support http2 will be refused.
+func (client *Client) newHTTPTransport(s *remoteServer, idleTimeout time.Duration, h2Only bool) *http.Transport {
+	return &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			raw, err := client.dialServerRaw(s)
+			if err != nil {
+				return nil, err
+			}
+			conn := tls.Client(raw, s.tlsConf)
+			if err := conn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if p := conn.ConnectionState().NegotiatedProtocol; h2Only && p != "h2" {
+				conn.Close()
+				return nil, fmt.Errorf("server doesn't support h2, negotiated protocol: [%s]", p)
+			}
+			return conn, nil
+		},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     idleTimeout,
+	}
+}
+
+// httpAddr is the address of a connection over http.
+type httpAddr string
+
+func (a httpAddr) Network() string { return "http" }
+func (a httpAddr) String() string  { return string(a) }
+
+// deadlineTimer calls f when the deadline is exceeded. It is used by
+// connections over http, which can't interrupt blocked reads and writes.
+type deadlineTimer struct {
+	mu sync.Mutex
+	t  *time.Timer
+	f  func()
+}
+
+func (d *deadlineTimer) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.t != nil {
+		d.t.Stop()
+		d.t = nil
+	}
+	if t.IsZero() {
+		return
+	}
+	d.t = time.AfterFunc(time.Until(t), d.f)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// http upgrade transport sends a websocket-like HTTP/1.1 Upgrade request
+// without Sec-WebSocket-Key. After the 101 response, both sides use the
+// underlying connection directly, without websocket framing.
+// Reverse proxies route it like websocket.
+
+// isHTTPUpgradeRequest reports whether r is a http upgrade request.
+func isHTTPUpgradeRequest(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r) && len(r.Header.Get("Sec-WebSocket-Key")) == 0
+}
+
+// dialHTTPUpgrade dials s and does a http upgrade on the wss path.
+func (client *Client) dialHTTPUpgrade(s *remoteServer) (net.Conn, error) {
+	raw, err := client.dialServerRaw(s)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, s.tlsConf)
+	conn.SetDeadline(time.Now().Add(defaultHandShakeTimeout))
+	c := newBufferedConn(conn)
+	if err := httpUpgrade(c, s.wssURL, s.wsDialer.Subprotocols[0]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// httpUpgrade sends a http upgrade request to c and reads the response.
+func httpUpgrade(c *bufferedConn, url, subprotocol string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Protocol", subprotocol)
+	if err := req.Write(c); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(c.r, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+	return nil
+}
+
+// acceptHTTPUpgrade hijacks the connection of r and sends the 101 response.
+// It returns the connection and the subprotocol client requested.
+func acceptHTTPUpgrade(w http.ResponseWriter, r *http.Request) (net.Conn, string, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, "", errors.New("response doesn't support hijack")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, "", err
+	}
+
+	subprotocol := strings.TrimSpace(r.Header.Get("Sec-WebSocket-Protocol"))
+	resp := "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"
+	if len(subprotocol) != 0 {
+		resp += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	conn.SetWriteDeadline(time.Now().Add(defaultHandShakeTimeout))
+	if _, err := conn.Write([]byte(resp + "\r\n")); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: brw.Reader}, subprotocol, nil
+}
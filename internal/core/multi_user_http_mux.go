@@ -20,79 +20,270 @@
 package core
 
 import (
+	"fmt"
 	"net"
 	"net/http"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
-	"github.com/xtaci/smux"
 )
 
+// userKey is the host and path of a user. Empty host matches all hosts,
+// and "*.example.com" matches one label, e.g. "a.example.com".
+type userKey struct {
+	host string
+	path string
+}
+
+func newUserKey(a *Args) userKey {
+	return userKey{host: normalizeHost(a.Host), path: a.Path}
+}
+
+// normalizeHost returns the lower case host without port.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// regexUser is a user whose path is a regular expression.
+type regexUser struct {
+	pattern string
+	re      *regexp.Regexp
+	dst     string
+	seq     uint64 // users added earlier are checked first
+}
+
+// regexUsers are regex users of a host. They are indexed by the literal
+// prefix of their regexes, so only those whose prefix matches the path
+// are checked. Regexes without a literal prefix are always checked.
+type regexUsers struct {
+	byPrefix map[string][]*regexUser // in the order they were added
+	lens     map[int]int             // prefix length to the number of prefixes
+	n        int
+}
+
+func newRegexUsers() *regexUsers {
+	return &regexUsers{byPrefix: make(map[string][]*regexUser), lens: make(map[int]int)}
+}
+
+func (rs *regexUsers) add(prefix string, u *regexUser) {
+	if len(rs.byPrefix[prefix]) == 0 {
+		rs.lens[len(prefix)]++
+	}
+	rs.byPrefix[prefix] = append(rs.byPrefix[prefix], u)
+	rs.n++
+}
+
+// del deletes the user of pattern, it reports whether the user exists.
+func (rs *regexUsers) del(pattern string) bool {
+	for prefix, users := range rs.byPrefix {
+		for i, u := range users {
+			if u.pattern != pattern {
+				continue
+			}
+			users = append(users[:i:i], users[i+1:]...)
+			rs.n--
+			if len(users) != 0 {
+				rs.byPrefix[prefix] = users
+				return true
+			}
+			delete(rs.byPrefix, prefix)
+			if rs.lens[len(prefix)]--; rs.lens[len(prefix)] == 0 {
+				delete(rs.lens, len(prefix))
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the first added user that matches path, and the end of
+// the match.
+func (rs *regexUsers) match(path string) (best *regexUser, end int) {
+	for l := range rs.lens {
+		if l > len(path) {
+			continue
+		}
+		for _, u := range rs.byPrefix[path[:l]] {
+			if best != nil && u.seq > best.seq {
+				break
+			}
+			if loc := u.re.FindStringIndex(path); loc != nil {
+				best, end = u, loc[1]
+				break
+			}
+		}
+	}
+	return best, end
+}
+
 type mux struct {
 	sync.RWMutex
-	pathMap map[string]string
+	userMap   map[userKey]string     // exact paths
+	prefixMap map[userKey]string     // path prefixes
+	regexMap  map[string]*regexUsers // hosts to users
+	regexLen  int
+	regexSeq  uint64
 
 	enableMux bool
+	maxStream int
 	timeout   time.Duration
 
-	upgrader   websocket.Upgrader
-	smuxConfig *smux.Config
+	upgrader websocket.Upgrader
+	muxer    *muxer
 
 	log *logrus.Logger
 }
 
-func newMux(enableMux bool, timeout time.Duration, logger *logrus.Logger) *mux {
+func newMux(enableMux bool, maxStream int, m *muxer, timeout time.Duration, logger *logrus.Logger) *mux {
 	return &mux{
-		pathMap: make(map[string]string),
+		userMap:   make(map[userKey]string),
+		prefixMap: make(map[userKey]string),
+		regexMap:  make(map[string]*regexUsers),
 
 		enableMux: enableMux,
+		maxStream: maxStream,
 		timeout:   timeout,
 		upgrader: websocket.Upgrader{
 			HandshakeTimeout: defaultHandShakeTimeout,
 			ReadBufferSize:   0, // buffers allocated by the HTTP server are used
 			WriteBufferSize:  0,
 
-			Subprotocols: []string{websocketSubprotocolSmuxON, websocketSubprotocolSmuxOFF},
+			Subprotocols: muxSubprotocols,
 		},
-		smuxConfig: defaultSmuxConfig(),
-		log:        logger,
+		muxer: m,
+		log:   logger,
 	}
 }
 
-func (m *mux) add(a []Args) {
+// add adds users. No user will be added if one of them is invalid.
+func (m *mux) add(a []Args) error {
+	res := make([]*regexp.Regexp, len(a))
+	prefixes := make([]string, len(a))
+	for i := range a {
+		switch a[i].Match {
+		case MatchExact, MatchPrefix:
+		case MatchRegex:
+			re, err := regexp.Compile(a[i].Path)
+			if err != nil {
+				return fmt.Errorf("invalid regex [%s], %v", a[i].Path, err)
+			}
+			// an anchored regex has no literal prefix, so the prefix
+			// is from the original one.
+			prefixes[i], _ = re.LiteralPrefix()
+			// a regex matches from the beginning of the path
+			res[i] = regexp.MustCompile("^(?:" + a[i].Path + ")")
+		default:
+			return fmt.Errorf("invalid match [%s]", a[i].Match)
+		}
+	}
+
 	m.Lock()
+	defer m.Unlock()
 	for i := range a {
-		m.pathMap[a[i].Path] = a[i].Dst
+		k := newUserKey(&a[i])
+		switch a[i].Match {
+		case MatchExact:
+			m.userMap[k] = a[i].Dst
+		case MatchPrefix:
+			m.prefixMap[k] = a[i].Dst
+		case MatchRegex:
+			m.delRegexLocked(k)
+			rs := m.regexMap[k.host]
+			if rs == nil {
+				rs = newRegexUsers()
+				m.regexMap[k.host] = rs
+			}
+			m.regexSeq++
+			rs.add(prefixes[i], &regexUser{pattern: k.path, re: res[i], dst: a[i].Dst, seq: m.regexSeq})
+			m.regexLen++
+		}
 	}
-	m.Unlock()
+	return nil
 }
 
 func (m *mux) del(a []Args) {
 	m.Lock()
 	for i := range a {
-		delete(m.pathMap, a[i].Path)
+		k := newUserKey(&a[i])
+		switch a[i].Match {
+		case MatchExact:
+			delete(m.userMap, k)
+		case MatchPrefix:
+			delete(m.prefixMap, k)
+		case MatchRegex:
+			m.delRegexLocked(k)
+		}
 	}
 	m.Unlock()
 }
 
+func (m *mux) delRegexLocked(k userKey) {
+	rs := m.regexMap[k.host]
+	if rs == nil || !rs.del(k.path) {
+		return
+	}
+	m.regexLen--
+	if rs.n == 0 {
+		delete(m.regexMap, k.host)
+	}
+}
+
 func (m *mux) reset() {
 	m.Lock()
-	m.pathMap = make(map[string]string)
+	m.userMap = make(map[userKey]string)
+	m.prefixMap = make(map[userKey]string)
+	m.regexMap = make(map[string]*regexUsers)
+	m.regexLen = 0
 	m.Unlock()
 }
 
-func (m *mux) get(path string) (des string, ok bool) {
+// get returns the destination of host and path, and the remainder of the
+// path after the matched prefix or regex. Users with exact host are
+// preferred to wildcard host, then to users without host. For the same
+// host, exact path is preferred to the longest prefix, then to regexes.
+func (m *mux) get(host, path string) (des, remainder string, ok bool) {
+	host = normalizeHost(host)
+	hosts := make([]string, 0, 3)
+	if len(host) != 0 {
+		hosts = append(hosts, host)
+		if i := strings.IndexByte(host, '.'); i > 0 {
+			hosts = append(hosts, "*"+host[i:])
+		}
+	}
+	hosts = append(hosts, "")
+
 	m.RLock()
-	des, ok = m.pathMap[path]
-	m.RUnlock()
-	return
+	defer m.RUnlock()
+	for _, h := range hosts {
+		if des, ok = m.userMap[userKey{host: h, path: path}]; ok {
+			return des, "", true
+		}
+		if len(m.prefixMap) != 0 {
+			for i := len(path); i > 0; i-- {
+				if des, ok = m.prefixMap[userKey{host: h, path: path[:i]}]; ok {
+					return des, path[i:], true
+				}
+			}
+		}
+		if rs := m.regexMap[h]; rs != nil {
+			if u, end := rs.match(path); u != nil {
+				return u.dst, path[end:], true
+			}
+		}
+	}
+	return "", "", false
 }
 
 func (m *mux) len() int {
 	m.RLock()
-	n := len(m.pathMap)
+	n := len(m.userMap) + len(m.prefixMap) + m.regexLen
 	m.RUnlock()
 	return n
 }
@@ -100,10 +291,35 @@ func (m *mux) len() int {
 // ServeHTTP implements http.Handler interface
 func (m *mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	requestEntry := m.log.WithField("client", r.RemoteAddr)
-	dst, ok := m.get(r.URL.Path)
+	dst, remainder, ok := m.get(r.Host, r.URL.Path)
 
 	if !ok {
-		requestEntry.Warnf("invalid path [%s]", r.URL.Path)
+		requestEntry.Warnf("invalid host [%s] or path [%s]", r.Host, r.URL.Path)
+		return
+	}
+	if len(remainder) != 0 {
+		requestEntry = requestEntry.WithField("path_remainder", remainder)
+	}
+
+	if isGRPCRequest(r) {
+		leftConn, err := newGRPCServerConn(w, r)
+		if err != nil {
+			requestEntry.Warnf("grpc response failed, %v", err)
+			return
+		}
+		defer leftConn.finish(w)
+		m.handleClientConn(leftConn, dst, requestEntry)
+		return
+	}
+
+	if isHTTPUpgradeRequest(r) {
+		leftConn, subprotocol, err := acceptHTTPUpgrade(w, r)
+		if err != nil {
+			requestEntry.Warnf("http upgrade failed, %v", err)
+			return
+		}
+		defer leftConn.Close()
+		m.handleClientConnBySubprotocol(leftConn, subprotocol, dst, requestEntry)
 		return
 	}
 
@@ -115,14 +331,20 @@ func (m *mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer leftWSConn.Close()
 
 	leftConn := wrapWebSocketConn(leftWSConn)
-	switch leftWSConn.Subprotocol() {
+	m.handleClientConnBySubprotocol(leftConn, leftWSConn.Subprotocol(), dst, requestEntry)
+}
+
+func (m *mux) handleClientConnBySubprotocol(leftConn net.Conn, subprotocol, dst string, requestEntry *logrus.Entry) {
+	switch subprotocol {
 	case websocketSubprotocolSmuxON:
-		m.handleClientMuxConn(leftConn, dst, requestEntry)
+		m.handleClientMuxConn(leftConn, MuxerSmux, dst, requestEntry)
+	case websocketSubprotocolYamux:
+		m.handleClientMuxConn(leftConn, MuxerYamux, dst, requestEntry)
 	case websocketSubprotocolSmuxOFF:
 		m.handleClientConn(leftConn, dst, requestEntry)
 	default:
 		if m.enableMux {
-			m.handleClientMuxConn(leftConn, dst, requestEntry)
+			m.handleClientMuxConn(leftConn, "", dst, requestEntry)
 		} else {
 			m.handleClientConn(leftConn, dst, requestEntry)
 		}
@@ -140,9 +362,9 @@ func (m *mux) handleClientConn(leftConn net.Conn, dst string, requestEntry *logr
 	openTunnel(leftConn, rightConn, m.timeout)
 }
 
-func (m *mux) handleClientMuxConn(leftConn net.Conn, dst string, requestEntry *logrus.Entry) {
+func (m *mux) handleClientMuxConn(leftConn net.Conn, protocol, dst string, requestEntry *logrus.Entry) {
 	handleClientConn := func(c net.Conn, r *logrus.Entry) {
 		m.handleClientConn(c, dst, r)
 	}
-	handleClientMuxConn(m.smuxConfig, defaultSmuxMaxStream, leftConn, handleClientConn, requestEntry)
+	handleClientMuxConn(m.muxer, protocol, m.maxStream, leftConn, handleClientConn, requestEntry)
 }
@@ -0,0 +1,244 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errNoRawUser = errors.New("no such user")
+
+// rawUser is a user in raw tls mode. It is identified by the tls server
+// name, the psk preamble, or both.
+type rawUser struct {
+	host     string
+	verifier *pskVerifier // nil if user has no psk
+	keyID    [pskKeyIDLen]byte
+	dst      string
+}
+
+type rawUserKey struct {
+	host string
+	psk  string
+}
+
+// rawUsers are users in raw tls mode. It has the same methods as mux,
+// so the controller can manage both of them.
+type rawUsers struct {
+	sync.RWMutex
+	sniUsers map[string]*rawUser              // users without psk, keyed by host
+	pskUsers map[rawUserKey]*rawUser          // users with psk
+	keyIDs   map[[pskKeyIDLen]byte][]*rawUser // users with psk, keyed by key id
+
+	log *logrus.Logger
+}
+
+func newRawUsers(log *logrus.Logger) *rawUsers {
+	return &rawUsers{
+		sniUsers: make(map[string]*rawUser),
+		pskUsers: make(map[rawUserKey]*rawUser),
+		keyIDs:   make(map[[pskKeyIDLen]byte][]*rawUser),
+		log:      log,
+	}
+}
+
+// add adds users. No user will be added if one of them is invalid.
+func (r *rawUsers) add(a []Args) error {
+	for i := range a {
+		if len(a[i].Host) == 0 && len(a[i].PSK) == 0 {
+			return fmt.Errorf("user of dst [%s] needs a host or a psk", a[i].Dst)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for i := range a {
+		u := &rawUser{host: normalizeHost(a[i].Host), dst: a[i].Dst}
+		if len(a[i].PSK) == 0 {
+			// server name is sent in plaintext, it is not a secret.
+			r.log.Warnf("WARNING: raw tls user of host [%s] has no psk, anyone who knows the host can use it", u.host)
+			r.sniUsers[u.host] = u
+			continue
+		}
+		u.verifier = newPSKVerifier(a[i].PSK)
+		u.keyID = pskKeyID([]byte(a[i].PSK))
+		k := rawUserKey{host: u.host, psk: a[i].PSK}
+		r.delPSKUserLocked(k)
+		r.pskUsers[k] = u
+		r.keyIDs[u.keyID] = append(r.keyIDs[u.keyID], u)
+	}
+	return nil
+}
+
+func (r *rawUsers) delPSKUserLocked(k rawUserKey) {
+	u := r.pskUsers[k]
+	if u == nil {
+		return
+	}
+	delete(r.pskUsers, k)
+	users := r.keyIDs[u.keyID]
+	for i := range users {
+		if users[i] == u {
+			users = append(users[:i:i], users[i+1:]...)
+			break
+		}
+	}
+	if len(users) == 0 {
+		delete(r.keyIDs, u.keyID)
+	} else {
+		r.keyIDs[u.keyID] = users
+	}
+}
+
+func (r *rawUsers) del(a []Args) {
+	r.Lock()
+	for i := range a {
+		host := normalizeHost(a[i].Host)
+		if len(a[i].PSK) == 0 {
+			delete(r.sniUsers, host)
+		} else {
+			r.delPSKUserLocked(rawUserKey{host: host, psk: a[i].PSK})
+		}
+	}
+	r.Unlock()
+}
+
+func (r *rawUsers) reset() {
+	r.Lock()
+	r.sniUsers = make(map[string]*rawUser)
+	r.pskUsers = make(map[rawUserKey]*rawUser)
+	r.keyIDs = make(map[[pskKeyIDLen]byte][]*rawUser)
+	r.Unlock()
+}
+
+func (r *rawUsers) len() int {
+	r.RLock()
+	n := len(r.sniUsers) + len(r.pskUsers)
+	r.RUnlock()
+	return n
+}
+
+// hostMatch reports whether host matches pattern, which can be a wildcard,
+// e.g. "*.example.com".
+func hostMatch(pattern, host string) bool {
+	if pattern == host {
+		return true
+	}
+	i := strings.IndexByte(host, '.')
+	return i > 0 && pattern == "*"+host[i:]
+}
+
+// identify returns the destination of the user of c. Users without psk
+// are matched by serverName first. Otherwise, a psk preamble is read
+// from c, and it is verified by the users of its key id.
+func (r *rawUsers) identify(c *bufferedConn, serverName string) (string, error) {
+	serverName = normalizeHost(serverName)
+	r.RLock()
+	u := r.sniUsers[serverName]
+	if u == nil && len(serverName) != 0 {
+		if i := strings.IndexByte(serverName, '.'); i > 0 {
+			u = r.sniUsers["*"+serverName[i:]]
+		}
+	}
+	n := len(r.pskUsers)
+	r.RUnlock()
+	if u != nil {
+		return u.dst, nil
+	}
+	if n == 0 {
+		return "", errNoRawUser
+	}
+
+	b, err := peekPSKPreamble(c)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	r.RLock()
+	for _, pu := range r.keyIDs[preambleKeyID(b)] {
+		if len(pu.host) != 0 && !hostMatch(pu.host, serverName) {
+			continue
+		}
+		err := pu.verifier.verify(b, now)
+		if err == errPSKInvalidPreamble {
+			continue
+		}
+		if err != nil {
+			r.RUnlock()
+			return "", err
+		}
+		u = pu
+		break
+	}
+	r.RUnlock()
+	if u == nil {
+		return "", errNoRawUser
+	}
+	if _, err := c.r.Discard(pskPreambleLen); err != nil {
+		return "", err
+	}
+	return u.dst, nil
+}
+
+// serveRaw serves users in raw tls mode on l.
+func (mus *MUServer) serveRaw(l net.Listener) error {
+	mus.listenerLocker.Lock()
+	mus.serverListener = l
+	mus.listenerLocker.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("listener.Accept: %v", err)
+		}
+		go mus.handleRawConn(c)
+	}
+}
+
+func (mus *MUServer) handleRawConn(leftConn net.Conn) {
+	defer leftConn.Close()
+	requestEntry := mus.logger.WithField("client", leftConn.RemoteAddr())
+
+	var alpn, serverName string
+	if tlsConn, ok := leftConn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			requestEntry.Warnf("tls handshake failed, %v", err)
+			return
+		}
+		state := tlsConn.ConnectionState()
+		alpn, serverName = state.NegotiatedProtocol, state.ServerName
+	}
+
+	bc := newBufferedConn(leftConn)
+	dst, err := mus.rawUsers.identify(bc, serverName)
+	if err != nil {
+		requestEntry.Warnf("invalid user of server name [%s], %v", serverName, err)
+		return
+	}
+	mus.mux.handleClientConnBySubprotocol(bc, alpn, dst, requestEntry)
+}
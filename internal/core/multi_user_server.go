@@ -24,10 +24,12 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
@@ -43,11 +45,25 @@ type MUCmd struct {
 	ArgsBunch []Args `json:"args_bunch,omitempty"`
 }
 
+//Args is a user. Host is optional, e.g. "example.com" or "*.example.com".
+//Match is how Path is matched, MatchExact (default), MatchPrefix or MatchRegex.
+//In raw tls mode, a user is identified by Host (the tls server name), PSK
+//or both, Path is not used.
 type Args struct {
-	Path string `json:"path,omitempty"`
-	Dst  string `json:"dst,omitempty"`
+	Host  string `json:"host,omitempty"`
+	Path  string `json:"path,omitempty"`
+	Match string `json:"match,omitempty"`
+	PSK   string `json:"psk,omitempty"`
+	Dst   string `json:"dst,omitempty"`
 }
 
+//Args match types
+const (
+	MatchExact  = ""
+	MatchPrefix = "prefix"
+	MatchRegex  = "regex"
+)
+
 //MUCmd opt id
 const (
 	OptAdd   = 1
@@ -73,13 +89,25 @@ const (
 type MUServer struct {
 	conf *MUServerConfig
 
-	mux            *mux
+	mux      *mux
+	rawUsers *rawUsers // only in raw tls mode
+	users    muUsers   // users managed by the controller
+
 	server         http.Server
-	serverListener net.Listener
+	listenerLocker sync.Mutex
+	serverListener net.Listener // only in raw tls mode
 	controller     http.Server
 	logger         *logrus.Logger
 }
 
+// muUsers are users managed by the controller.
+type muUsers interface {
+	add(a []Args) error
+	del(a []Args)
+	reset()
+	len() int
+}
+
 //NewMUServer init a multi-user server
 func NewMUServer(conf *MUServerConfig) (*MUServer, error) {
 
@@ -93,9 +121,38 @@ func NewMUServer(conf *MUServerConfig) (*MUServer, error) {
 		mus.logger.SetLevel(logrus.ErrorLevel)
 	}
 
-	mus.mux = newMux(conf.EnableMux, conf.Timeout, mus.logger)
+	muxer, err := newMuxer(&conf.SmuxOptions)
+	if err != nil {
+		return nil, err
+	}
+	if conf.MuxMaxStream < 0 {
+		return nil, errors.New("mux max stream must not be negative")
+	}
+	if conf.MuxMaxStream == 0 {
+		conf.MuxMaxStream = defaultSmuxMaxStream
+	}
+	mus.mux = newMux(conf.EnableMux, conf.MuxMaxStream, muxer, conf.Timeout, mus.logger)
+	mus.users = mus.mux
+	if conf.EnableRawTLS {
+		if conf.EnableGRPC {
+			return nil, errors.New("raw tls mode can't be used with grpc")
+		}
+		mus.rawUsers = newRawUsers(mus.logger)
+		mus.users = mus.rawUsers
+	}
 
 	mus.server = http.Server{Addr: conf.ServerAddr, Handler: mus.mux}
+	if conf.EnableGRPC {
+		if conf.DisableTLS {
+			// the tls proxy in front of server should send h2c, e.g. nginx grpc_pass
+			mus.server.Protocols = new(http.Protocols)
+			mus.server.Protocols.SetHTTP1(true)
+			mus.server.Protocols.SetUnencryptedHTTP2(true)
+		}
+	} else {
+		// websocket needs HTTP/1.1, don't let ServeTLS enable HTTP/2
+		mus.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
 	mus.controller = http.Server{Addr: conf.HTTPControllerAddr, Handler: mus}
 	mus.conf = conf
 
@@ -118,20 +175,48 @@ func (mus *MUServer) StartServer() error {
 	defer l.Close()
 
 	if mus.conf.DisableTLS {
+		if len(mus.conf.ClientCA) != 0 {
+			return errors.New("client auth can't be used with disable-tls")
+		}
+		if mus.conf.EnableRawTLS {
+			return mus.serveRaw(l)
+		}
 		return mus.server.Serve(l)
 	}
 
+	tlsConf := new(tls.Config)
+	if err := mus.conf.TLSOptions.apply(tlsConf); err != nil {
+		return err
+	}
+	if mus.conf.EnableGRPC {
+		tlsConf.NextProtos = addH2(tlsConf.NextProtos)
+	} else {
+		tlsConf.NextProtos = removeH2(tlsConf.NextProtos)
+	}
+	if err := setClientAuth(tlsConf, mus.conf.ClientCA, mus.conf.ClientAuth); err != nil {
+		return fmt.Errorf("client auth: %v", err)
+	}
 	// need to generate cert
 	if len(mus.conf.Cert) == 0 && len(mus.conf.Key) == 0 {
-		tlsConf := new(tls.Config)
 		cers, err := generateCertificate(mus.conf.ServerName)
 		if err != nil {
 			return fmt.Errorf("generate certificate: %v", err)
 		}
 		mus.logger.Print("WARNING: you are using a self-signed certificate")
 		tlsConf.Certificates = cers
-		mus.server.TLSConfig = tlsConf
 	}
+	if mus.conf.EnableRawTLS {
+		if len(tlsConf.Certificates) == 0 {
+			cer, err := tls.LoadX509KeyPair(mus.conf.Cert, mus.conf.Key)
+			if err != nil {
+				return fmt.Errorf("failed to load key and cert, %v", err)
+			}
+			tlsConf.Certificates = []tls.Certificate{cer}
+		}
+		setRawModeALPN(tlsConf)
+		return mus.serveRaw(tls.NewListener(l, tlsConf))
+	}
+	mus.server.TLSConfig = tlsConf
 	return mus.server.ServeTLS(l, mus.conf.Cert, mus.conf.Key)
 }
 
@@ -145,6 +230,11 @@ func (mus *MUServer) CloseController() error {
 }
 
 func (mus *MUServer) CloseServer() error {
+	mus.listenerLocker.Lock()
+	if mus.serverListener != nil {
+		mus.serverListener.Close()
+	}
+	mus.listenerLocker.Unlock()
 	return mus.server.Close()
 }
 
@@ -176,20 +266,23 @@ func (mus *MUServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			sendMURes(w, ResErr, 0, "empty args")
 			return
 		}
-		mus.mux.add(muCmd.ArgsBunch)
+		if err := mus.users.add(muCmd.ArgsBunch); err != nil {
+			sendMURes(w, ResErr, 0, err.Error())
+			return
+		}
 		sendMURes(w, ResOK, 0, "")
 	case OptDel:
 		if len(muCmd.ArgsBunch) == 0 {
 			sendMURes(w, ResErr, 0, "empty args")
 			return
 		}
-		mus.mux.del(muCmd.ArgsBunch)
+		mus.users.del(muCmd.ArgsBunch)
 		sendMURes(w, ResOK, 0, "")
 	case OptReset:
-		mus.mux.reset()
+		mus.users.reset()
 		sendMURes(w, ResOK, 0, "")
 	case OptPing:
-		sendMURes(w, ResOK, mus.mux.len(), "")
+		sendMURes(w, ResOK, mus.users.len(), "")
 	default:
 		mus.logger.Warnf("invalid opt from %s , %d", r.RemoteAddr, muCmd.Opt)
 		sendMURes(w, ResErr, 0, "invalid opt")
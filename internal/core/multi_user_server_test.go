@@ -22,6 +22,7 @@ package core
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,6 +33,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -202,3 +205,243 @@ func Test_MU(t *testing.T) {
 	muServer.CloseServer()
 	wg.Wait()
 }
+
+func Test_mux_get_regex_order(t *testing.T) {
+	m := newMux(false, defaultSmuxMaxStream, nil, time.Second, nil)
+	err := m.add([]Args{
+		{Path: "/r/[0-9]+", Match: MatchRegex, Dst: "digits"},
+		{Path: "/.*", Match: MatchRegex, Dst: "any"},
+		{Path: "/r/a.*", Match: MatchRegex, Dst: "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// regexes are indexed by their literal prefixes, but the first added
+	// one that matches wins.
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/r/1", "digits"},
+		{"/r/abc", "any"},
+		{"/x", "any"},
+	}
+	for _, tt := range tests {
+		if got, _, _ := m.get("", tt.path); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	m.del([]Args{{Path: "/.*", Match: MatchRegex}})
+	if got, _, _ := m.get("", "/r/abc"); got != "a" {
+		t.Errorf("after del, got %s, want a", got)
+	}
+	if _, _, ok := m.get("", "/x"); ok {
+		t.Error("deleted regex should not match")
+	}
+	if m.len() != 2 {
+		t.Errorf("got %d users, want 2", m.len())
+	}
+}
+
+func Test_mux_get(t *testing.T) {
+	m := newMux(false, defaultSmuxMaxStream, nil, time.Second, nil)
+	err := m.add([]Args{
+		{Path: "/ws", Dst: "path only"},
+		{Host: "A.example.com", Path: "/ws", Dst: "a"},
+		{Host: "*.example.com", Path: "/ws", Dst: "wildcard"},
+		{Host: "b.example.com", Path: "/b", Dst: "b"},
+		{Path: "/p/", Match: MatchPrefix, Dst: "prefix"},
+		{Path: "/p/long/", Match: MatchPrefix, Dst: "long prefix"},
+		{Path: "/r/[0-9]+", Match: MatchRegex, Dst: "regex"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, path    string
+		want, wantRem string
+		wantOK        bool
+	}{
+		{"a.example.com", "/ws", "a", "", true},
+		{"a.example.com:443", "/ws", "a", "", true},
+		{"c.example.com", "/ws", "wildcard", "", true},
+		{"other.com", "/ws", "path only", "", true},
+		{"b.example.com", "/b", "b", "", true},
+		{"c.example.com", "/b", "", "", false},
+		{"", "/p/token", "prefix", "token", true},
+		{"", "/p/long/token", "long prefix", "token", true},
+		{"", "/p", "", "", false},
+		{"", "/r/123/token", "regex", "/token", true},
+		{"", "/x/r/123", "", "", false},
+	}
+	for _, tt := range tests {
+		got, rem, ok := m.get(tt.host, tt.path)
+		if got != tt.want || rem != tt.wantRem || ok != tt.wantOK {
+			t.Errorf("%s%s: got %s %s %v, want %s %s %v", tt.host, tt.path, got, rem, ok, tt.want, tt.wantRem, tt.wantOK)
+		}
+	}
+
+	m.del([]Args{{Host: "a.example.com", Path: "/ws"}, {Path: "/r/[0-9]+", Match: MatchRegex}})
+	if got, _, _ := m.get("a.example.com", "/ws"); got != "wildcard" {
+		t.Errorf("after del, got %s, want wildcard", got)
+	}
+	if m.len() != 5 {
+		t.Errorf("got %d users, want 5", m.len())
+	}
+
+	if err := m.add([]Args{{Path: "/ok", Dst: "ok"}, {Path: "(", Match: MatchRegex}}); err == nil {
+		t.Error("invalid regex should fail")
+	}
+	if _, _, ok := m.get("", "/ok"); ok {
+		t.Error("no user should be added if one of them is invalid")
+	}
+}
+
+func Test_rawUsers_identify(t *testing.T) {
+	r := newRawUsers(logrus.StandardLogger())
+	err := r.add([]Args{
+		{Host: "a.example.com", Dst: "a"},
+		{Host: "*.example.com", Dst: "wildcard"},
+		{PSK: "p1", Dst: "psk 1"},
+		{Host: "b.other.com", PSK: "p2", Dst: "psk 2"},
+		{Host: "c.other.com", PSK: "p2", Dst: "psk 2 of c"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.add([]Args{{Dst: "no host and psk"}}); err == nil {
+		t.Fatal("user without host and psk should fail")
+	}
+
+	identify := func(serverName, psk string) (string, error) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		if len(psk) != 0 {
+			b, err := newPSKPreamble([]byte(psk), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			go c2.Write(append(b, "data"...))
+		}
+		bc := newBufferedConn(c1)
+		dst, err := r.identify(bc, serverName)
+		if err == nil && len(psk) != 0 {
+			// preamble should be discarded
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(bc, buf); err != nil || string(buf) != "data" {
+				t.Fatalf("want data after preamble, got %s, %v", buf, err)
+			}
+		}
+		return dst, err
+	}
+
+	tests := []struct {
+		serverName, psk string
+		want            string
+		wantErr         bool
+	}{
+		{"a.example.com", "", "a", false},
+		{"A.example.com", "", "a", false},
+		{"c.example.com", "", "wildcard", false},
+		{"other.com", "p1", "psk 1", false},
+		{"b.other.com", "p2", "psk 2", false},
+		{"c.other.com", "p2", "psk 2 of c", false},
+		{"d.other.com", "p2", "", true},
+		{"other.com", "wrong", "", true},
+	}
+	for _, tt := range tests {
+		got, err := identify(tt.serverName, tt.psk)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s %s: got %s %v, want %s", tt.serverName, tt.psk, got, err, tt.want)
+		}
+	}
+
+	r.del([]Args{{Host: "a.example.com"}, {PSK: "p1"}, {Host: "c.other.com", PSK: "p2"}})
+	if got, _ := identify("a.example.com", ""); got != "wildcard" {
+		t.Errorf("after del, got %s, want wildcard", got)
+	}
+	if _, err := identify("other.com", "p1"); err == nil {
+		t.Error("deleted psk user should fail")
+	}
+	if got, _ := identify("b.other.com", "p2"); got != "psk 2" {
+		t.Errorf("after del, got %s, want psk 2", got)
+	}
+	if r.len() != 2 || len(r.keyIDs) != 1 {
+		t.Errorf("got %d users and %d key ids, want 2 and 1", r.len(), len(r.keyIDs))
+	}
+}
+
+func Test_MUServer_raw(t *testing.T) {
+	echo, err := runDstServer("127.0.0.1:0", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.close()
+
+	mus, err := NewMUServer(&MUServerConfig{EnableRawTLS: true, Timeout: time.Second * 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mus.users.add([]Args{
+		{Host: "a.example.com", Dst: echo.l.Addr().String()},
+		{PSK: "secret", Dst: echo.l.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cers, err := generateCertificate("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConf := &tls.Config{Certificates: cers}
+	setRawModeALPN(tlsConf)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go mus.serveRaw(l)
+	defer mus.CloseServer()
+
+	dial := func(serverName, psk string) error {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second * 5))
+		data := []byte("hello")
+		if len(psk) != 0 {
+			b, err := newPSKPreamble([]byte(psk), time.Now())
+			if err != nil {
+				return err
+			}
+			c.Write(b)
+		}
+		if _, err := c.Write(data); err != nil {
+			return err
+		}
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if !bytes.Equal(buf, data) {
+			return errors.New("data corrupted")
+		}
+		return nil
+	}
+
+	if err := dial("a.example.com", ""); err != nil {
+		t.Errorf("sni user: %v", err)
+	}
+	if err := dial("other.com", "secret"); err != nil {
+		t.Errorf("psk user: %v", err)
+	}
+	if err := dial("other.com", "wrong"); err == nil {
+		t.Error("unknown user should be rejected")
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// muxPool holds client's mux sessions. New streams are opened on the
+// session with the fewest active streams. Only one session is dialed at
+// a time, concurrent callers wait for it.
+type muxPool struct {
+	maxStream int
+	// spare keeps one session with free streams, so the stream that
+	// fills the last session doesn't wait for the next one.
+	spare bool
+	dial  func() (*muxSession, error)
+	log   *logrus.Logger
+
+	mu       sync.Mutex
+	sessions []*muxSession
+	dialCall *muxDialCall // not nil if a session is being dialed
+	closed   bool
+}
+
+var errMuxPoolClosed = errors.New("mux pool closed")
+
+type muxDialCall struct {
+	done chan struct{}
+	sess *muxSession
+	err  error
+}
+
+func newMuxPool(maxStream int, spare bool, dial func() (*muxSession, error), log *logrus.Logger) *muxPool {
+	return &muxPool{maxStream: maxStream, spare: spare, dial: dial, log: log}
+}
+
+func (p *muxPool) getStream() (*muxStream, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errMuxPoolClosed
+		}
+		sess := p.pickLocked()
+		if sess == nil {
+			call := p.dialLocked()
+			p.mu.Unlock()
+
+			<-call.done
+			if call.err != nil {
+				return nil, call.err
+			}
+			stream, err := call.sess.openStream(p.maxStream)
+			if err == ErrTooManyStreams || err == errMuxSessionDraining {
+				continue // taken by other callers
+			}
+			if err == nil && p.spare {
+				p.ensureSpare()
+			}
+			return stream, err
+		}
+		p.mu.Unlock()
+
+		stream, err := sess.openStream(p.maxStream)
+		switch err {
+		case nil:
+			if p.spare {
+				p.ensureSpare()
+			}
+			return stream, nil
+		case ErrTooManyStreams, errMuxSessionDraining:
+			continue
+		default:
+			p.log.Warnf("deleted err sess %p: open stream: %v", sess, err)
+			sess.Close()
+			p.remove(sess)
+		}
+	}
+}
+
+// pickLocked returns the session with the fewest active streams that
+// can open a new stream. It returns nil if there is no such session.
+func (p *muxPool) pickLocked() *muxSession {
+	var best *muxSession
+	bestN := 0
+	for _, sess := range p.sessions {
+		n := sess.NumStreams()
+		if n >= p.maxStream || !sess.available() {
+			continue
+		}
+		if best == nil || n < bestN {
+			best, bestN = sess, n
+		}
+	}
+	return best
+}
+
+// dialLocked dials a new session if there is no dialing one.
+func (p *muxPool) dialLocked() *muxDialCall {
+	if p.dialCall != nil {
+		return p.dialCall
+	}
+
+	call := &muxDialCall{done: make(chan struct{})}
+	p.dialCall = call
+	go func() {
+		call.sess, call.err = p.dial()
+		p.mu.Lock()
+		if call.err == nil && p.closed {
+			call.sess.Close()
+			call.sess, call.err = nil, errMuxPoolClosed
+		}
+		if call.err == nil {
+			p.sessions = append(p.sessions, call.sess)
+		}
+		p.dialCall = nil
+		p.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// ensureSpare dials a new session in the background if all sessions are full.
+func (p *muxPool) ensureSpare() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.dialCall != nil || p.pickLocked() != nil {
+		return
+	}
+	call := p.dialLocked()
+	go func() {
+		<-call.done
+		if call.err != nil {
+			p.log.Warnf("dial spare sess: %v", call.err)
+		}
+	}()
+}
+
+func (p *muxPool) remove(sess *muxSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.sessions {
+		if p.sessions[i] == sess {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// reap closes and deletes idle and drained sessions. If spare is enabled,
+// one session with free streams is kept.
+func (p *muxPool) reap(now time.Time, idleTimeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keepSpare := p.spare
+	sessions := p.sessions[:0]
+	for _, sess := range p.sessions {
+		timeout := idleTimeout
+		if keepSpare && sess.NumStreams() < p.maxStream && sess.available() {
+			keepSpare = false
+			timeout = math.MaxInt64
+		}
+		if sess.reap(now, timeout) {
+			p.log.Debugf("reaped sess %p", sess)
+			continue
+		}
+		sessions = append(sessions, sess)
+	}
+	for i := len(sessions); i < len(p.sessions); i++ {
+		p.sessions[i] = nil
+	}
+	p.sessions = sessions
+}
+
+// close closes all sessions in the background, including the spare one.
+// Sessions that are being dialed will be closed when they are ready.
+func (p *muxPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, sess := range p.sessions {
+		go sess.Close() // it may block on writing to the server
+	}
+	p.sessions = nil
+}
+
+func (p *muxPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.sessions)
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestMuxPool(t *testing.T, maxStream int, spare bool, dialed *int32) *muxPool {
+	return newMuxPool(maxStream, spare, func() (*muxSession, error) {
+		atomic.AddInt32(dialed, 1)
+		time.Sleep(50 * time.Millisecond)
+		return newTestMuxSession(t, 0, 0), nil
+	}, logrus.StandardLogger())
+}
+
+func Test_muxPool_leastLoaded(t *testing.T) {
+	var dialed int32
+	p := newTestMuxPool(t, 2, false, &dialed)
+
+	var streams []*muxStream
+	for i := 0; i < 3; i++ {
+		s, err := p.getStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, s)
+	}
+	if dialed != 2 {
+		t.Fatalf("want 2 sessions, got %d", dialed)
+	}
+
+	// the first session has 2 streams, the second one has 1
+	s, err := p.getStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.sess != streams[2].sess {
+		t.Fatal("stream should be opened on the least loaded session")
+	}
+
+	streams[0].Close()
+	streams[1].Close()
+	s, err = p.getStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.sess != streams[0].sess {
+		t.Fatal("stream should be opened on the least loaded session")
+	}
+}
+
+func Test_muxPool_concurrentDial(t *testing.T) {
+	var dialed int32
+	p := newTestMuxPool(t, 16, false, &dialed)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.getStream(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if dialed != 1 {
+		t.Fatalf("concurrent callers should share one dial, got %d dials", dialed)
+	}
+}
+
+func Test_muxPool_spare(t *testing.T) {
+	var dialed int32
+	p := newTestMuxPool(t, 1, true, &dialed)
+
+	if _, err := p.getStream(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if p.len() != 2 {
+		t.Fatalf("a spare session should be dialed, got %d sessions", p.len())
+	}
+
+	// the spare session is used without dialing, and a new spare is dialed
+	if _, err := p.getStream(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&dialed); n != 3 {
+		t.Fatalf("want 3 dials, got %d", n)
+	}
+
+	// one idle session is kept
+	p.reap(time.Now().Add(time.Hour), time.Second)
+	if p.len() != 3 {
+		t.Fatalf("sessions with streams and one idle session should be kept, got %d", p.len())
+	}
+}
+
+func Test_muxPool_close(t *testing.T) {
+	var dialed int32
+	p := newTestMuxPool(t, 1, true, &dialed)
+
+	if _, err := p.getStream(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	p.mu.Lock()
+	sessions := append([]*muxSession(nil), p.sessions...)
+	p.mu.Unlock()
+	if len(sessions) != 2 {
+		t.Fatalf("want a session and a spare one, got %d", len(sessions))
+	}
+
+	p.close()
+	time.Sleep(100 * time.Millisecond)
+	for _, sess := range sessions {
+		if !sess.IsClosed() {
+			t.Fatal("sessions and the spare one should be closed")
+		}
+	}
+	if _, err := p.getStream(); err != errMuxPoolClosed {
+		t.Fatalf("want errMuxPoolClosed, got %v", err)
+	}
+}
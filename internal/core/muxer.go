@@ -0,0 +1,223 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/yamux"
+	"github.com/xtaci/smux"
+)
+
+// multiplexer protocols
+const (
+	MuxerSmux  = "smux"
+	MuxerYamux = "yamux"
+)
+
+// yamuxVersion is the first byte of every yamux frame. smux frames start
+// with smux version, which is 1 or 2, so server can tell them apart.
+const yamuxVersion = 0
+
+// muxSubprotocols tell server whether client enabled mux and which protocol
+// it uses. They are websocket subprotocols in wss mode and ALPN values in
+// raw tls mode.
+var muxSubprotocols = []string{websocketSubprotocolSmuxON, websocketSubprotocolYamux, websocketSubprotocolSmuxOFF}
+
+func muxSubprotocol(enableMux bool, protocol string) string {
+	switch {
+	case enableMux && protocol == MuxerYamux:
+		return websocketSubprotocolYamux
+	case enableMux:
+		return websocketSubprotocolSmuxON
+	default:
+		return websocketSubprotocolSmuxOFF
+	}
+}
+
+func isMuxSubprotocol(p string) bool {
+	for _, s := range muxSubprotocols {
+		if p == s {
+			return true
+		}
+	}
+	return false
+}
+
+// setRawModeALPN lets server negotiate mux with clients by ALPN in raw tls
+// mode. muxSubprotocols are only added if client offers one of them, so
+// other clients, e.g. browsers to the fallback, are not affected.
+func setRawModeALPN(conf *tls.Config) {
+	muxConf := conf.Clone()
+	muxConf.NextProtos = append(append([]string(nil), muxSubprotocols...), conf.NextProtos...)
+	conf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, p := range hello.SupportedProtos {
+			if isMuxSubprotocol(p) {
+				return muxConf, nil
+			}
+		}
+		return nil, nil
+	}
+}
+
+// muxSess is a multiplexed session.
+type muxSess interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	NumStreams() int
+	IsClosed() bool
+	Close() error
+}
+
+// muxer creates smux or yamux sessions.
+type muxer struct {
+	smuxConfig  *smux.Config
+	yamuxConfig *yamux.Config
+}
+
+func newMuxer(o *SmuxOptions) (*muxer, error) {
+	smuxConfig, err := o.newSmuxConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid smux options: %v", err)
+	}
+
+	yamuxConfig := yamux.DefaultConfig()
+	yamuxConfig.LogOutput = ioutil.Discard
+	return &muxer{smuxConfig: smuxConfig, yamuxConfig: yamuxConfig}, nil
+}
+
+func checkMuxer(protocol string) error {
+	switch protocol {
+	case "", MuxerSmux, MuxerYamux:
+		return nil
+	default:
+		return fmt.Errorf("unknown multiplexer [%s]", protocol)
+	}
+}
+
+// client returns a client session of protocol over c. Empty protocol
+// means smux.
+func (m *muxer) client(protocol string, c net.Conn) (muxSess, error) {
+	if protocol == MuxerYamux {
+		s, err := yamux.Client(c, m.yamuxConfig)
+		if err != nil {
+			return nil, err
+		}
+		return yamuxSess{s}, nil
+	}
+
+	s, err := smux.Client(c, m.smuxConfig)
+	if err != nil {
+		return nil, err
+	}
+	return smuxSess{s}, nil
+}
+
+// server returns a server session of protocol over c. If protocol is
+// empty, it will be detected from the first byte client sent.
+func (m *muxer) server(protocol string, c net.Conn) (muxSess, error) {
+	if len(protocol) == 0 {
+		bc, ok := c.(*bufferedConn)
+		if !ok {
+			bc = newBufferedConn(c)
+		}
+		// client sends keepalive frames, it won't be silent longer than this.
+		bc.SetReadDeadline(time.Now().Add(m.smuxConfig.KeepAliveTimeout))
+		b, err := bc.r.Peek(1)
+		bc.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		protocol = MuxerSmux
+		if b[0] == yamuxVersion {
+			protocol = MuxerYamux
+		}
+		c = bc
+	}
+
+	if protocol == MuxerYamux {
+		s, err := yamux.Server(c, m.yamuxConfig)
+		if err != nil {
+			return nil, err
+		}
+		return yamuxSess{s}, nil
+	}
+
+	s, err := smux.Server(c, m.smuxConfig)
+	if err != nil {
+		return nil, err
+	}
+	return smuxSess{s}, nil
+}
+
+// isMuxSessClosedErr reports whether err is expected when the session
+// is closed by the peer.
+func isMuxSessClosedErr(err error) bool {
+	if e, ok := err.(*websocket.CloseError); ok && e.Code == websocket.CloseNormalClosure {
+		return true
+	}
+	return err == io.EOF || err == yamux.ErrSessionShutdown
+}
+
+type smuxSess struct {
+	*smux.Session
+}
+
+func (s smuxSess) OpenStream() (net.Conn, error) {
+	stream, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s smuxSess) AcceptStream() (net.Conn, error) {
+	stream, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+type yamuxSess struct {
+	*yamux.Session
+}
+
+func (s yamuxSess) OpenStream() (net.Conn, error) {
+	stream, err := s.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s yamuxSess) AcceptStream() (net.Conn, error) {
+	stream, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
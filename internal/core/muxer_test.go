@@ -0,0 +1,159 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func Test_muxer_detect(t *testing.T) {
+	m, err := newMuxer(&SmuxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, protocol := range []string{MuxerSmux, MuxerYamux} {
+		c1, c2 := net.Pipe()
+		go handleClientMuxConn(m, "", defaultSmuxMaxStream, c2, func(c net.Conn, _ *logrus.Entry) {
+			io.Copy(c, c) // echo
+		}, logrus.NewEntry(logrus.StandardLogger()))
+
+		sess, err := m.client(protocol, c1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream, err := sess.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.SetDeadline(time.Now().Add(time.Second))
+		if _, err := stream.Write([]byte{1}); err != nil {
+			t.Fatalf("%s: %v", protocol, err)
+		}
+		if _, err := io.ReadFull(stream, make([]byte, 1)); err != nil {
+			t.Fatalf("%s: %v", protocol, err)
+		}
+		sess.Close()
+	}
+}
+
+func Test_yamux(t *testing.T) {
+	sc, cc := *serverTestConfig, *clientTestConfig
+	sc.EnableWSS = false
+	sc.EnableMux = true
+	cc.EnableWSS = false
+	cc.EnableMux = true
+	cc.Muxer = MuxerYamux
+	test(&sc, &cc, t)
+}
+
+func Test_yamux_wss_auto_detect(t *testing.T) {
+	sc, cc := *serverTestConfig, *clientTestConfig
+	sc.EnableWSS = true
+	sc.WSSPath = "/"
+	sc.EnableMux = false
+	cc.EnableWSS = true
+	cc.WSSPath = "/"
+	cc.EnableMux = true
+	cc.Muxer = MuxerYamux
+	test(&sc, &cc, t)
+}
+
+func Test_rawTLS_mux_negotiation(t *testing.T) {
+	sc, cc := *serverTestConfig, *clientTestConfig
+	sc.EnableWSS = false
+	cc.EnableWSS = false
+	cc.MuxALPN = true
+
+	tests := []struct {
+		name        string
+		serverMux   bool
+		clientMux   bool
+		clientMuxer string
+	}{
+		{"server off, client smux", false, true, MuxerSmux},
+		{"server off, client yamux", false, true, MuxerYamux},
+		{"server on, client off", true, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc.EnableMux = tt.serverMux
+			cc.EnableMux = tt.clientMux
+			cc.Muxer = tt.clientMuxer
+			test(&sc, &cc, t)
+		})
+	}
+}
+
+func Test_Server_setRawModeALPN(t *testing.T) {
+	server, err := NewServer(&ServerConfig{BindAddr: serverBindAddr, DstAddr: dstAddr, Timeout: time.Second, TLSOptions: TLSOptions{ALPN: "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		clientProtos []string
+		want         string
+	}{
+		{[]string{"http/1.1", websocketSubprotocolYamux}, websocketSubprotocolYamux},
+		{[]string{"h2", "http/1.1"}, "http/1.1"}, // e.g. browsers to the fallback
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		go tls.Server(c2, server.tlsConf).Handshake()
+		c := tls.Client(c1, &tls.Config{InsecureSkipVerify: true, NextProtos: tt.clientProtos})
+		if err := c.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.ConnectionState().NegotiatedProtocol; got != tt.want {
+			t.Errorf("client protos %v, got %s, want %s", tt.clientProtos, got, tt.want)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func Test_Client_muxALPN(t *testing.T) {
+	for _, muxALPN := range []bool{false, true} {
+		cc := *clientTestConfig
+		cc.EnableWSS = false
+		cc.EnableMux = true
+		cc.MuxALPN = muxALPN
+		client, err := NewClient(&cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offered := false
+		for _, p := range client.balancer.servers[0].tlsConf.NextProtos {
+			offered = offered || isMuxSubprotocol(p)
+		}
+		if offered != muxALPN {
+			t.Errorf("MuxALPN %v: NextProtos = %v", muxALPN, client.balancer.servers[0].tlsConf.NextProtos)
+		}
+		client.Close()
+	}
+}
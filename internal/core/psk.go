@@ -0,0 +1,180 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// psk preamble, it is sent by client right after the tls handshake
+// in raw tls mode if psk is set.
+//
+//	+-----+-----------+-------+----------------------------------+
+//	| VER | TIMESTAMP | NONCE | HMAC-SHA256(VER|TIMESTAMP|NONCE) |
+//	+-----+-----------+-------+----------------------------------+
+//	|  1  |     8     |  16   |                32                |
+//	+-----+-----------+-------+----------------------------------+
+//
+// TIMESTAMP is unix seconds. Preambles that are too old, or whose nonce
+// has been seen, are rejected. The first pskKeyIDLen bytes of NONCE are the
+// key id of psk, the rest are random.
+const (
+	pskPreambleVersion = 1
+
+	pskNonceLen    = 16
+	pskKeyIDLen    = 8
+	pskPreambleLen = 1 + 8 + pskNonceLen + sha256.Size
+
+	// max time difference between client and server
+	pskMaxTimeSkew = time.Minute * 2
+)
+
+var (
+	errPSKInvalidPreamble = errors.New("invalid psk preamble")
+	errPSKTimeSkew        = errors.New("psk preamble timestamp is out of range")
+	errPSKReplay          = errors.New("psk preamble replayed")
+)
+
+func newPSKPreamble(psk []byte, now time.Time) ([]byte, error) {
+	b := make([]byte, pskPreambleLen)
+	b[0] = pskPreambleVersion
+	binary.BigEndian.PutUint64(b[1:9], uint64(now.Unix()))
+	id := pskKeyID(psk)
+	copy(b[9:], id[:])
+	if _, err := io.ReadFull(rand.Reader, b[9+pskKeyIDLen:9+pskNonceLen]); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, psk)
+	mac.Write(b[:9+pskNonceLen])
+	copy(b[9+pskNonceLen:], mac.Sum(nil))
+	return b, nil
+}
+
+// pskKeyID identifies psk without revealing it, so a server with many
+// keys can find the key of a preamble without trying all of them.
+func pskKeyID(psk []byte) (id [pskKeyIDLen]byte) {
+	mac := hmac.New(sha256.New, psk)
+	mac.Write([]byte("mtt psk key id"))
+	copy(id[:], mac.Sum(nil))
+	return id
+}
+
+// preambleKeyID returns the key id of preamble b.
+func preambleKeyID(b []byte) (id [pskKeyIDLen]byte) {
+	copy(id[:], b[9:])
+	return id
+}
+
+// writePSKPreamble writes a new preamble of psk to w.
+func writePSKPreamble(w io.Writer, psk string) error {
+	b, err := newPSKPreamble([]byte(psk), time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// pskVerifier verifies psk preambles and remembers their nonces
+// to reject replays.
+type pskVerifier struct {
+	psk []byte
+
+	mu        sync.Mutex
+	seen      map[[pskNonceLen]byte]time.Time // nonce -> expire time
+	lastClean time.Time
+}
+
+func newPSKVerifier(psk string) *pskVerifier {
+	return &pskVerifier{psk: []byte(psk), seen: make(map[[pskNonceLen]byte]time.Time)}
+}
+
+func (v *pskVerifier) verify(b []byte, now time.Time) error {
+	if len(b) != pskPreambleLen || b[0] != pskPreambleVersion {
+		return errPSKInvalidPreamble
+	}
+	mac := hmac.New(sha256.New, v.psk)
+	mac.Write(b[:9+pskNonceLen])
+	if !hmac.Equal(mac.Sum(nil), b[9+pskNonceLen:]) {
+		return errPSKInvalidPreamble
+	}
+
+	ts := time.Unix(int64(binary.BigEndian.Uint64(b[1:9])), 0)
+	if ts.Before(now.Add(-pskMaxTimeSkew)) || ts.After(now.Add(pskMaxTimeSkew)) {
+		return errPSKTimeSkew
+	}
+
+	var nonce [pskNonceLen]byte
+	copy(nonce[:], b[9:9+pskNonceLen])
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.Sub(v.lastClean) > pskMaxTimeSkew {
+		for n, expire := range v.seen {
+			if now.After(expire) {
+				delete(v.seen, n)
+			}
+		}
+		v.lastClean = now
+	}
+	if _, ok := v.seen[nonce]; ok {
+		return errPSKReplay
+	}
+	// a preamble with this nonce will be rejected by the timestamp check after then
+	v.seen[nonce] = ts.Add(pskMaxTimeSkew)
+	return nil
+}
+
+// readPSKPreamble reads and verifies the preamble from c. If it is invalid,
+// the data read from c is kept in c's buffer.
+func (v *pskVerifier) readPSKPreamble(c *bufferedConn) error {
+	b, err := peekPSKPreamble(c)
+	if err != nil {
+		return err
+	}
+	if err := v.verify(b, time.Now()); err != nil {
+		return err
+	}
+	_, err = c.r.Discard(pskPreambleLen)
+	return err
+}
+
+// peekPSKPreamble peeks the preamble from c without verifying it.
+func peekPSKPreamble(c *bufferedConn) ([]byte, error) {
+	c.SetReadDeadline(time.Now().Add(defaultHandShakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	// fail fast if it is not a preamble
+	b, err := c.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != pskPreambleVersion {
+		return nil, errPSKInvalidPreamble
+	}
+	return c.r.Peek(pskPreambleLen)
+}
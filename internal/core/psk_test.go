@@ -0,0 +1,111 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func Test_pskVerifier(t *testing.T) {
+	now := time.Now()
+	v := newPSKVerifier("secret")
+
+	b, err := newPSKPreamble([]byte("secret"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(b, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(b, now); err != errPSKReplay {
+		t.Fatalf("want errPSKReplay, got %v", err)
+	}
+
+	wrongKey, err := newPSKPreamble([]byte("wrong"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(wrongKey, now); err != errPSKInvalidPreamble {
+		t.Fatalf("want errPSKInvalidPreamble, got %v", err)
+	}
+
+	old, err := newPSKPreamble([]byte("secret"), now.Add(-pskMaxTimeSkew-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(old, now); err != errPSKTimeSkew {
+		t.Fatalf("want errPSKTimeSkew, got %v", err)
+	}
+
+	// expired nonces are cleaned
+	later := now.Add(pskMaxTimeSkew * 3)
+	fresh, err := newPSKPreamble([]byte("secret"), later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.verify(fresh, later); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.seen) != 1 {
+		t.Fatalf("want 1 nonce, got %d", len(v.seen))
+	}
+}
+
+func Test_preambleKeyID(t *testing.T) {
+	now := time.Now()
+	b1, err := newPSKPreamble([]byte("secret"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := newPSKPreamble([]byte("secret"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preambleKeyID(b1) != pskKeyID([]byte("secret")) || preambleKeyID(b2) != pskKeyID([]byte("secret")) {
+		t.Fatal("preamble doesn't carry the key id")
+	}
+	if pskKeyID([]byte("secret")) == pskKeyID([]byte("wrong")) {
+		t.Fatal("different psks have the same key id")
+	}
+	if bytes.Equal(b1, b2) {
+		t.Fatal("preambles of the same time are the same")
+	}
+}
+
+func Test_psk(t *testing.T) {
+	serverTestConfig.EnableWSS = false
+	clientTestConfig.EnableWSS = false
+	serverTestConfig.PSK = "secret"
+	clientTestConfig.PSK = "secret"
+	defer func() {
+		serverTestConfig.PSK = ""
+		clientTestConfig.PSK = ""
+	}()
+
+	serverTestConfig.EnableMux = false
+	clientTestConfig.EnableMux = false
+	test(serverTestConfig, clientTestConfig, t)
+
+	serverTestConfig.EnableMux = true
+	clientTestConfig.EnableMux = true
+	test(serverTestConfig, clientTestConfig, t)
+}
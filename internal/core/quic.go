@@ -0,0 +1,290 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+)
+
+// quic transport maps every connection to a QUIC stream. All streams to a
+// server share one QUIC connection, which replaces both the TLS connection
+// and the smux session. A stream is invisible to the server until client
+// sends something, so dst header is always enabled in quic mode.
+const (
+	// default ALPN if TLSOptions.ALPN is empty
+	quicALPN = "mtt"
+
+	quicMaxIncomingStreams = 1024
+)
+
+func newQUICConfig(idleTimeout time.Duration) *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: defaultHandShakeTimeout,
+		MaxIdleTimeout:       idleTimeout,
+		KeepAlivePeriod:      idleTimeout / 2,
+		MaxIncomingStreams:   quicMaxIncomingStreams,
+	}
+}
+
+var errQUICClientClosed = errors.New("quic client closed")
+
+// quicStreamConn is a net.Conn over a QUIC stream.
+type quicStreamConn struct {
+	*quic.Stream
+	localAddr, remoteAddr net.Addr
+
+	closeOnce sync.Once
+	onClose   func() // can be nil
+}
+
+// Close closes both directions of the stream.
+func (c *quicStreamConn) Close() error {
+	c.Stream.CancelRead(0)
+	err := c.Stream.Close()
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
+	return err
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// quicClientConn is the QUIC connections from client to a server. New
+// streams are opened on cur. If cur can't open more streams, it is retired
+// and will be closed after its last stream is closed.
+type quicClientConn struct {
+	sync.Mutex
+	cur     *quicConnRef
+	dialing *quicDial
+	all     map[*quicConnRef]struct{}
+	closed  bool
+}
+
+type quicConnRef struct {
+	conn    *quic.Conn
+	streams int
+	retired bool
+}
+
+// quicDial is a connection being dialed, other streams wait for it
+// instead of dialing their own.
+type quicDial struct {
+	done chan struct{}
+	err  error
+}
+
+// dialQUIC opens a stream on the QUIC connection to s, the connection
+// will be dialed if it is not alive or can't open more streams.
+func (client *Client) dialQUIC(s *remoteServer) (net.Conn, error) {
+	qc := &s.quicConn
+	for {
+		qc.Lock()
+		if qc.closed {
+			qc.Unlock()
+			return nil, errQUICClientClosed
+		}
+		if ref := qc.cur; ref != nil {
+			stream, err := ref.conn.OpenStream()
+			if err == nil {
+				ref.streams++
+				qc.Unlock()
+				return &quicStreamConn{
+					Stream:     stream,
+					localAddr:  ref.conn.LocalAddr(),
+					remoteAddr: ref.conn.RemoteAddr(),
+					onClose:    func() { qc.streamClosed(ref) },
+				}, nil
+			}
+			// connection is dead or too many streams, dial a new one
+			client.log.Debugf("quic open stream, %v", err)
+			qc.retire(ref)
+		}
+		if d := qc.dialing; d != nil {
+			qc.Unlock()
+			<-d.done
+			if d.err != nil {
+				return nil, d.err
+			}
+			continue
+		}
+		d := &quicDial{done: make(chan struct{})}
+		qc.dialing = d
+		qc.Unlock()
+
+		// don't hold the lock during the handshake, streams on other
+		// connections can still be closed.
+		addr := s.addrStats.bestAddr()
+		if len(addr) == 0 {
+			addr = s.addr
+		}
+		conn, err := client.dialQUICConn(s, addr)
+
+		qc.Lock()
+		qc.dialing = nil
+		if err == nil && qc.closed {
+			conn.CloseWithError(0, "")
+			err = errQUICClientClosed
+		}
+		if err == nil {
+			qc.add(conn)
+		}
+		d.err = err
+		close(d.done)
+		qc.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// add adds a new connection as cur. qc must be locked.
+func (qc *quicClientConn) add(conn *quic.Conn) {
+	ref := &quicConnRef{conn: conn}
+	if qc.all == nil {
+		qc.all = make(map[*quicConnRef]struct{})
+	}
+	qc.all[ref] = struct{}{}
+	qc.cur = ref
+	go func() {
+		<-conn.Context().Done()
+		qc.Lock()
+		delete(qc.all, ref)
+		if qc.cur == ref {
+			qc.cur = nil
+		}
+		qc.Unlock()
+	}()
+}
+
+// retire stops opening new streams on ref. qc must be locked.
+func (qc *quicClientConn) retire(ref *quicConnRef) {
+	ref.retired = true
+	if qc.cur == ref {
+		qc.cur = nil
+	}
+	if ref.streams == 0 {
+		ref.conn.CloseWithError(0, "")
+	}
+}
+
+func (qc *quicClientConn) streamClosed(ref *quicConnRef) {
+	qc.Lock()
+	defer qc.Unlock()
+	ref.streams--
+	if ref.retired && ref.streams == 0 {
+		ref.conn.CloseWithError(0, "")
+	}
+}
+
+// close closes all connections, no more streams can be opened.
+func (qc *quicClientConn) close() {
+	qc.Lock()
+	defer qc.Unlock()
+	qc.closed = true
+	qc.cur = nil
+	for ref := range qc.all {
+		ref.conn.CloseWithError(0, "")
+	}
+}
+
+func (client *Client) dialQUICConn(s *remoteServer, addr string) (*quic.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHandShakeTimeout)
+	defer cancel()
+	tr := &quic.Transport{Conn: pc}
+	conn, err := tr.Dial(ctx, udpAddr, s.tlsConf, newQUICConfig(client.conf.Timeout))
+	if err != nil {
+		tr.Close()
+		pc.Close()
+		return nil, err
+	}
+	// release the socket when the connection is closed
+	go func() {
+		<-conn.Context().Done()
+		tr.Close()
+		pc.Close()
+	}()
+	return conn, nil
+}
+
+// ServeQUIC accepts QUIC connections from pc, it blocks until pc or server
+// is closed.
+func (server *Server) ServeQUIC(pc net.PacketConn) error {
+	l, err := quic.Listen(pc, server.tlsConf, newQUICConfig(server.conf.Timeout))
+	if err != nil {
+		return err
+	}
+	server.listenerLocker.Lock()
+	server.quicListener = l
+	server.listenerLocker.Unlock()
+	server.log.Printf("plugin listen at udp %s", l.Addr())
+
+	for {
+		conn, err := l.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) {
+				return nil
+			}
+			return fmt.Errorf("quic accept: %v", err)
+		}
+		go server.handleQUICConn(conn)
+	}
+}
+
+func (server *Server) handleQUICConn(conn *quic.Conn) {
+	requestEntry := logrus.WithField("quic_client", conn.RemoteAddr())
+	requestEntry.Debug("quic connection accepted")
+	state := conn.ConnectionState().TLS
+	if !server.clientAuthed(&state) {
+		requestEntry.Warn("client certificate verification failed")
+		conn.CloseWithError(0, "")
+		return
+	}
+
+	dst := server.routeDst(&state)
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			requestEntry.Debugf("quic accept stream, %v", err)
+			return
+		}
+		go func() {
+			c := &quicStreamConn{Stream: stream, localAddr: conn.LocalAddr(), remoteAddr: conn.RemoteAddr()}
+			defer c.Close()
+			server.handleClientConn(c, dst, requestEntry)
+		}()
+	}
+}
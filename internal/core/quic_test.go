@@ -0,0 +1,152 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// runQUICTest runs a quic server with an echo destination, and returns
+// a client of it.
+func runQUICTest(t *testing.T) (*Client, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dummyConnS2D := newDummyDialerListener()
+	echo, err := runDstServer("", dummyConnS2D, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(&ServerConfig{
+		BindAddr:   pc.LocalAddr().String(),
+		DstAddr:    dstAddr,
+		Timeout:    time.Second * 30,
+		EnableQUIC: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.testDialDst = dummyConnS2D.connect
+	go server.ServeQUIC(pc)
+
+	client, err := NewClient(&ClientConfig{
+		BindAddr:           clientBindAddr,
+		RemoteAddr:         pc.LocalAddr().String(),
+		Timeout:            time.Second * 30,
+		MuxMaxStream:       4,
+		InsecureSkipVerify: true,
+		EnableQUIC:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		server.Close()
+		echo.close()
+		pc.Close()
+	}
+}
+
+func Test_quic(t *testing.T) {
+	client, cleanup := runQUICTest(t)
+	defer cleanup()
+
+	// streams share one quic connection
+	for i := 0; i < 3; i++ {
+		localConn, clientConn := net.Pipe()
+		go client.ForwardConn(clientConn)
+
+		data := make([]byte, 256*1024)
+		rand.Read(data)
+		localConn.SetDeadline(time.Now().Add(time.Second * 10))
+		go localConn.Write(data)
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(localConn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatal("data err")
+		}
+		localConn.Close()
+	}
+}
+
+func Test_quic_retire(t *testing.T) {
+	client, cleanup := runQUICTest(t)
+	defer cleanup()
+	s := client.balancer.servers[0]
+	qc := &s.quicConn
+
+	c1, err := client.dialQUIC(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qc.Lock()
+	old := qc.cur.conn
+	qc.retire(qc.cur)
+	qc.Unlock()
+
+	// a new connection is dialed, the retired one is kept for its stream
+	c2, err := client.dialQUIC(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if old.Context().Err() != nil {
+		t.Fatal("retired connection should not be closed before its streams are closed")
+	}
+	c1.Close()
+	select {
+	case <-old.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("retired connection should be closed after its streams are closed")
+	}
+
+	qc.Lock()
+	cur := qc.cur.conn
+	qc.Unlock()
+	client.Close()
+	select {
+	case <-cur.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection should be closed by client.Close")
+	}
+	if _, err := client.dialQUIC(s); err != errQUICClientClosed {
+		t.Fatalf("want errQUICClientClosed, got %v", err)
+	}
+}
+
+func Test_quic_config(t *testing.T) {
+	if _, err := NewClient(&ClientConfig{BindAddr: clientBindAddr, RemoteAddr: serverBindAddr, Timeout: time.Second, MuxMaxStream: 4, EnableQUIC: true, EnableMux: true}); err == nil {
+		t.Fatal("quic with mux should fail")
+	}
+	if _, err := NewServer(&ServerConfig{BindAddr: serverBindAddr, DstAddr: dstAddr, Timeout: time.Second, EnableQUIC: true, DisableTLS: true}); err == nil {
+		t.Fatal("quic with disable-tls should fail")
+	}
+}
@@ -30,17 +30,20 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	mathRand "math/rand"
 
 	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
 	"github.com/sirupsen/logrus"
-	"github.com/xtaci/smux"
 )
 
 //Server represents a Server instance
@@ -52,12 +55,19 @@ type Server struct {
 
 	upgrader websocket.Upgrader
 
-	netDialer *net.Dialer
+	netDialer    *net.Dialer
+	dstAllowList *dstAllowList
+	fallback     http.Handler
+	pskVerifier  *pskVerifier
+
+	splitHTTPSessions splitHTTPSessions
 
 	listenerLocker sync.Mutex
 	listener       net.Listener
+	quicListener   *quic.Listener
 
-	smuxConfig *smux.Config
+	muxer     *muxer
+	sniRoutes sniRoutes
 
 	log *logrus.Logger
 
@@ -72,7 +82,24 @@ func NewServer(c *ServerConfig) (*Server, error) {
 		return nil, errors.New("need bind address")
 	}
 
-	if len(c.DstAddr) == 0 {
+	if c.EnableUDP && !c.EnableDstHeader {
+		return nil, errors.New("udp needs dst header")
+	}
+
+	if c.EnableQUIC {
+		if c.DisableTLS || c.BindUnix {
+			return nil, errors.New("quic can't be used with disable-tls or bind-unix")
+		}
+		if c.EnableWSS || c.EnableGRPC || c.EnableSplitHTTP {
+			return nil, errors.New("quic can't be used with wss, grpc or split http")
+		}
+		if len(c.Fallback) != 0 {
+			return nil, errors.New("fallback can't be used with quic")
+		}
+		c.EnableDstHeader = true // quic needs dst header
+	}
+
+	if len(c.DstAddr) == 0 && !c.EnableDstHeader && len(c.SNIRoutes) == 0 {
 		return nil, errors.New("need destination server address")
 	}
 
@@ -80,6 +107,32 @@ func NewServer(c *ServerConfig) (*Server, error) {
 		return nil, errors.New("timeout value must at least 1 sec")
 	}
 
+	if c.MuxMaxStream < 0 {
+		return nil, errors.New("mux max stream must not be negative")
+	}
+	if c.MuxMaxStream == 0 {
+		c.MuxMaxStream = defaultSmuxMaxStream
+	}
+
+	if c.EnableGRPC {
+		if len(c.GRPCServiceName) == 0 {
+			c.GRPCServiceName = defaultGRPCServiceName
+		}
+		if c.EnableWSS && c.WSSPath == grpcPath(c.GRPCServiceName) {
+			return nil, errors.New("wss path and grpc path must be different")
+		}
+	}
+
+	if c.EnableSplitHTTP {
+		c.SplitHTTPPath = normalizeSplitHTTPPath(c.SplitHTTPPath)
+		if c.EnableWSS && c.WSSPath == c.SplitHTTPPath {
+			return nil, errors.New("wss path and split http path must be different")
+		}
+		if c.EnableGRPC && strings.HasPrefix(grpcPath(c.GRPCServiceName), c.SplitHTTPPath) {
+			return nil, errors.New("grpc path and split http path must be different")
+		}
+	}
+
 	//logger
 	server.log = logrus.New()
 	if c.Verbose {
@@ -94,12 +147,25 @@ func NewServer(c *ServerConfig) (*Server, error) {
 	server.tcpConfig = &tcpConfig{tfo: c.EnableTFO}
 	if server.conf.DisableTLS == false {
 		server.tlsConf = new(tls.Config)
+		if err := c.TLSOptions.apply(server.tlsConf); err != nil {
+			return nil, err
+		}
+		if c.EnableGRPC || c.EnableSplitHTTP {
+			server.tlsConf.NextProtos = addH2(server.tlsConf.NextProtos)
+		} else if c.EnableWSS {
+			server.tlsConf.NextProtos = removeH2(server.tlsConf.NextProtos)
+		} else if c.EnableQUIC && len(server.tlsConf.NextProtos) == 0 {
+			server.tlsConf.NextProtos = []string{quicALPN}
+		}
 		if len(c.Cert) == 0 && len(c.Key) == 0 { //self signed cert
 			cers, err := generateCertificate(server.conf.ServerName)
 			if err != nil {
 				return nil, fmt.Errorf("generate certificate: %v", err)
 			}
 			server.log.Print("WARNING: you are using a self-signed certificate")
+			if leaf, err := x509.ParseCertificate(cers[0].Certificate[0]); err == nil {
+				server.log.Printf("self-signed certificate pin: %s", certPin(leaf))
+			}
 			server.tlsConf.Certificates = cers
 		} else {
 			cer, err := tls.LoadX509KeyPair(c.Cert, c.Key) //load cert
@@ -108,6 +174,24 @@ func NewServer(c *ServerConfig) (*Server, error) {
 			}
 			server.tlsConf.Certificates = []tls.Certificate{cer}
 		}
+		if err := setClientAuth(server.tlsConf, c.ClientCA, c.ClientAuth); err != nil {
+			return nil, fmt.Errorf("client auth: %v", err)
+		}
+		if len(c.SNIRoutes) != 0 {
+			routes, err := parseSNIRoutes(c.SNIRoutes)
+			if err != nil {
+				return nil, err
+			}
+			server.sniRoutes = routes
+			server.tlsConf.GetCertificate = routes.getCertificate
+		}
+		if !c.EnableQUIC && (c.EnableRawTLS || !c.EnableWSS && !c.EnableGRPC && !c.EnableSplitHTTP) {
+			setRawModeALPN(server.tlsConf)
+		}
+	} else if len(c.ClientCA) != 0 {
+		return nil, errors.New("client auth can't be used with disable-tls")
+	} else if len(c.SNIRoutes) != 0 {
+		return nil, errors.New("sni routes can't be used with disable-tls")
 	}
 
 	//net dialer
@@ -116,20 +200,70 @@ func NewServer(c *ServerConfig) (*Server, error) {
 		Timeout: defaultHandShakeTimeout,
 	}
 
+	//dst allow list
+	l, err := newDstAllowList(c.DstAllowList)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dst allow list: %v", err)
+	}
+	if c.EnableDstHeader && l.len() == 0 {
+		server.log.Print("WARNING: dst allow list is empty, clients can connect to any destination except internal addresses")
+	}
+	server.dstAllowList = l
+
+	//psk
+	if len(c.PSK) != 0 {
+		if c.EnableQUIC || (c.EnableWSS || c.EnableGRPC) && !c.EnableRawTLS && !c.EnableSplitHTTP {
+			return nil, errors.New("psk can only be used in raw tls or split http mode")
+		}
+		server.pskVerifier = newPSKVerifier(c.PSK)
+	}
+	if c.EnableSplitHTTP && len(c.PSK) == 0 && len(c.ClientCA) == 0 {
+		return nil, errors.New("split http needs psk or client-ca to authenticate clients")
+	}
+
+	if c.EnableRawTLS && (c.EnableWSS || c.EnableGRPC || c.EnableSplitHTTP) && len(c.PSK) == 0 {
+		server.log.Print("WARNING: raw-tls without psk, raw clients are sniffed, see README")
+	}
+
+	//fallback
+	if len(c.Fallback) != 0 {
+		h, err := newFallbackHandler(c.Fallback)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback: %v", err)
+		}
+		if !c.EnableWSS && !c.EnableGRPC && !c.EnableSplitHTTP && !c.EnableDstHeader && !c.EnableMux && len(c.ClientCA) == 0 && len(c.PSK) == 0 {
+			server.log.Print("WARNING: fallback won't work in raw tls mode without dst-header, mux or client-ca")
+		}
+		server.fallback = h
+	}
+
 	//ws upgrader
 	server.upgrader = websocket.Upgrader{
 		HandshakeTimeout: defaultHandShakeTimeout,
 		ReadBufferSize:   0, // buffers allocated by the HTTP server are used
 		WriteBufferSize:  0,
 
-		Subprotocols: []string{websocketSubprotocolSmuxON, websocketSubprotocolSmuxOFF},
+		Subprotocols: muxSubprotocols,
 	}
 
-	server.smuxConfig = defaultSmuxConfig()
+	server.muxer, err = newMuxer(&c.SmuxOptions)
+	if err != nil {
+		return nil, err
+	}
+	server.splitHTTPSessions.m = make(map[string]*splitHTTPSession)
 	return server, nil
 }
 
 func (server *Server) Start() error {
+	if server.conf.EnableQUIC {
+		pc, err := net.ListenPacket("udp", server.conf.BindAddr)
+		if err != nil {
+			return fmt.Errorf("net.ListenPacket: %v", err)
+		}
+		defer pc.Close()
+		return server.ServeQUIC(pc)
+	}
+
 	var l net.Listener
 	var err error
 	if server.conf.BindUnix {
@@ -155,58 +289,180 @@ func (server *Server) ActiveAndServe(l net.Listener) error {
 	server.listenerLocker.Unlock()
 	server.log.Printf("plugin listen at %s", l.Addr())
 
-	if server.conf.EnableWSS {
+	if server.conf.EnableWSS || server.conf.EnableGRPC || server.conf.EnableSplitHTTP {
 		httpMux := http.NewServeMux()
-		httpMux.Handle(server.conf.WSSPath, server)
-		err := http.Serve(server.listener, httpMux)
+		if server.conf.EnableWSS {
+			httpMux.Handle(server.conf.WSSPath, server)
+		}
+		if server.conf.EnableGRPC {
+			httpMux.HandleFunc(grpcPath(server.conf.GRPCServiceName), server.serveGRPC)
+		}
+		if server.conf.EnableSplitHTTP {
+			httpMux.HandleFunc(server.conf.SplitHTTPPath, server.serveSplitHTTP)
+		}
+		if server.fallback != nil && !(server.conf.EnableWSS && server.conf.WSSPath == "/") {
+			httpMux.Handle("/", server.fallback)
+		}
+		httpServer := &http.Server{Handler: httpMux}
+		if server.conf.DisableTLS && server.conf.EnableGRPC {
+			// the tls proxy in front of server should send h2c, e.g. nginx grpc_pass
+			httpServer.Protocols = new(http.Protocols)
+			httpServer.Protocols.SetHTTP1(true)
+			httpServer.Protocols.SetUnencryptedHTTP2(true)
+		}
+		if server.conf.EnableRawTLS {
+			return server.serveRawAndHTTP(httpServer)
+		}
+		err := httpServer.Serve(server.listener)
 		if err != nil {
 			return fmt.Errorf("http.Serve: %v", err)
 		}
 	} else {
+		var fl *fallbackListener
+		if server.fallback != nil {
+			fl = newFallbackListener(l.Addr())
+			defer fl.Close()
+			go (&http.Server{Handler: server.fallback, IdleTimeout: server.conf.Timeout}).Serve(fl)
+		}
+
 		for {
 			leftConn, err := l.Accept()
 			if err != nil {
 				return fmt.Errorf("listener.Accept: %v", err)
 			}
+			go server.handleRawConn(leftConn, fl, nil)
+		}
+	}
+	return nil
+}
 
-			go func() {
-				defer leftConn.Close()
-
-				requestEntry := logrus.WithField("client", leftConn.RemoteAddr())
-				requestEntry.Debug("connection accepted")
-
-				// try handshake first, avoid later io err
-				if tlsConn, ok := leftConn.(*tls.Conn); ok {
-					if err := tlsConn.Handshake(); err != nil {
-						requestEntry.Errorf("tls handshake: %v", err)
-						return
-					}
-				}
+// handleRawConn handles a connection in raw tls mode. fl is the fallback
+// listener. If httpL is not nil, http connections are passed to it.
+func (server *Server) handleRawConn(leftConn net.Conn, fl, httpL *fallbackListener) {
+	requestEntry := logrus.WithField("client", leftConn.RemoteAddr())
+	requestEntry.Debug("connection accepted")
+
+	// try handshake first, avoid later io err
+	var alpn string
+	var state *tls.ConnectionState
+	if tlsConn, ok := leftConn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			requestEntry.Errorf("tls handshake: %v", err)
+			leftConn.Close()
+			return
+		}
+		s := tlsConn.ConnectionState()
+		state = &s
+		alpn = s.NegotiatedProtocol
+	}
+	dst := server.routeDst(state)
 
-				if server.conf.EnableMux {
-					server.handleClientMuxConn(leftConn, requestEntry)
-				} else {
-					server.handleClientConn(leftConn, requestEntry)
-				}
-			}()
+	if httpL != nil && !isMuxSubprotocol(alpn) {
+		if alpn == "h2" {
+			httpL.pass(leftConn)
+			return
+		}
+		bc := newBufferedConn(leftConn)
+		if !server.sniffRaw(bc) {
+			requestEntry.Debug("http connection sniffed")
+			httpL.pass(&sniffedConn{bufferedConn: bc, state: state})
+			return
+		}
+		leftConn = bc
+	}
+	defer leftConn.Close()
 
+	if server.fallback != nil || server.pskVerifier != nil {
+		bc, ok := leftConn.(*bufferedConn)
+		if !ok {
+			bc = newBufferedConn(leftConn)
+		}
+		if !server.isTunnelConn(bc, alpn, requestEntry) {
+			if fl == nil {
+				return
+			}
+			requestEntry.Debug("not a tunnel connection, fallback")
+			fl.serve(bc)
+			return
 		}
+		leftConn = bc
 	}
-	return nil
+
+	server.handleClientConnBySubprotocol(leftConn, alpn, dst, requestEntry)
 }
 
 //Close shutdown server
 func (server *Server) Close() error {
 	server.listenerLocker.Lock()
 	defer server.listenerLocker.Unlock()
+	if server.quicListener != nil {
+		return server.quicListener.Close()
+	}
 	if server.listener != nil {
 		return server.listener.Close()
 	}
 	return nil
 }
 
-func (server *Server) handleClientConn(leftConn net.Conn, requestEntry *logrus.Entry) {
-	rightConn, err := server.dialDst()
+// handleClientConn connects leftConn to dst, or the destination in its
+// dst header.
+func (server *Server) handleClientConn(leftConn net.Conn, dst string, requestEntry *logrus.Entry) {
+	checkAddr := false
+	if server.conf.EnableDstHeader {
+		var cmd byte
+		var headerDst string
+		var err error
+		for { // skip keepalive headers of idle pooled conns
+			leftConn.SetReadDeadline(time.Now().Add(server.conf.Timeout))
+			cmd, headerDst, err = readDstHeader(leftConn)
+			if err != nil || cmd != dstHeaderCmdKeepAlive {
+				break
+			}
+		}
+		if err == io.EOF {
+			// e.g. health check probes of client
+			requestEntry.Debug("closed before sending dst header")
+			return
+		}
+		if err != nil {
+			requestEntry.Errorf("read dst header, %v", err)
+			return
+		}
+		leftConn.SetReadDeadline(time.Time{})
+
+		if len(headerDst) != 0 {
+			if !server.dstAllowList.allow(headerDst) {
+				requestEntry.Warnf("dst %s is not allowed", headerDst)
+				return
+			}
+			dst = headerDst
+			checkAddr = !server.dstAllowList.listed(headerDst)
+		}
+		if len(dst) == 0 {
+			requestEntry.Error("no default destination")
+			return
+		}
+
+		switch cmd {
+		case dstHeaderCmdConnect:
+		case dstHeaderCmdUDP:
+			if !server.conf.EnableUDP {
+				requestEntry.Warn("udp is not enabled")
+				return
+			}
+			server.handleClientUDPConn(leftConn, dst, checkAddr, requestEntry)
+			return
+		default:
+			requestEntry.Errorf("unsupported dst header command %d", cmd)
+			return
+		}
+	}
+
+	if len(dst) == 0 {
+		requestEntry.Error("no destination")
+		return
+	}
+	rightConn, err := server.dialDst("tcp", dst, checkAddr)
 	if err != nil {
 		requestEntry.Errorf("dial dst, %v", err)
 		return
@@ -219,14 +475,49 @@ func (server *Server) handleClientConn(leftConn net.Conn, requestEntry *logrus.E
 	}
 }
 
-func (server *Server) handleClientMuxConn(leftConn net.Conn, requestEntry *logrus.Entry) {
-	handleClientMuxConn(server.smuxConfig, defaultSmuxMaxStream, leftConn, server.handleClientConn, requestEntry)
+func (server *Server) handleClientUDPConn(leftConn net.Conn, dst string, checkAddr bool, requestEntry *logrus.Entry) {
+	rightConn, err := server.dialDst("udp", dst, checkAddr)
+	if err != nil {
+		requestEntry.Errorf("dial udp dst, %v", err)
+		return
+	}
+	defer rightConn.Close()
+
+	err = relayUDP(leftConn, rightConn, server.conf.Timeout)
+	if err != nil {
+		requestEntry.Errorf("relayUDP, %v", err)
+	}
+}
+
+// handleClientMuxConn handles leftConn as a mux session of protocol. Empty
+// protocol will be detected.
+func (server *Server) handleClientMuxConn(leftConn net.Conn, protocol, dst string, requestEntry *logrus.Entry) {
+	handleClientConn := func(c net.Conn, r *logrus.Entry) {
+		server.handleClientConn(c, dst, r)
+	}
+	handleClientMuxConn(server.muxer, protocol, server.conf.MuxMaxStream, leftConn, handleClientConn, requestEntry)
 }
 
 // ServeHTTP implements http.Handler interface
 func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	requestEntry := logrus.WithField("http_client", r.RemoteAddr)
 	requestEntry.Debug("http connection accepted")
+	if server.fallback != nil && !server.isTunnelRequest(r) {
+		requestEntry.Debug("not a tunnel request, fallback")
+		server.fallback.ServeHTTP(w, r)
+		return
+	}
+	if isHTTPUpgradeRequest(r) {
+		leftConn, subprotocol, err := acceptHTTPUpgrade(w, r)
+		if err != nil {
+			requestEntry.Errorf("http upgrade, %v", err)
+			return
+		}
+		defer leftConn.Close()
+		server.handleClientConnBySubprotocol(leftConn, subprotocol, server.routeDst(r.TLS), requestEntry)
+		return
+	}
+
 	leftWSConn, err := server.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		requestEntry.Errorf("upgrade http request, %v", err)
@@ -234,26 +525,51 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	leftConn := wrapWebSocketConn(leftWSConn)
+	server.handleClientConnBySubprotocol(leftConn, leftWSConn.Subprotocol(), server.routeDst(r.TLS), requestEntry)
+}
 
-	switch leftWSConn.Subprotocol() {
+// handleClientConnBySubprotocol handles leftConn in mux mode or not by
+// the subprotocol or ALPN client requested.
+func (server *Server) handleClientConnBySubprotocol(leftConn net.Conn, subprotocol, dst string, requestEntry *logrus.Entry) {
+	switch subprotocol {
 	case websocketSubprotocolSmuxON:
-		server.handleClientMuxConn(leftConn, requestEntry)
+		server.handleClientMuxConn(leftConn, MuxerSmux, dst, requestEntry)
+	case websocketSubprotocolYamux:
+		server.handleClientMuxConn(leftConn, MuxerYamux, dst, requestEntry)
 	case websocketSubprotocolSmuxOFF:
-		server.handleClientConn(leftConn, requestEntry)
+		server.handleClientConn(leftConn, dst, requestEntry)
 	default:
 		if server.conf.EnableMux {
-			server.handleClientMuxConn(leftConn, requestEntry)
+			server.handleClientMuxConn(leftConn, "", dst, requestEntry)
 		} else {
-			server.handleClientConn(leftConn, requestEntry)
+			server.handleClientConn(leftConn, dst, requestEntry)
 		}
 	}
 }
 
-func (server *Server) dialDst() (net.Conn, error) {
+// dialDst dials dst. If checkAddr is true, dst won't be dialed if it is
+// resolved to an internal address.
+func (server *Server) dialDst(network, dst string, checkAddr bool) (net.Conn, error) {
 	if server.testDialDst != nil {
 		return server.testDialDst()
 	}
-	return server.netDialer.Dial("tcp", server.conf.DstAddr)
+	d := *server.netDialer
+	if network == "udp" {
+		d.Control = nil // tcp options
+	}
+	if checkAddr {
+		control := d.Control
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			if err := denyInternalAddr(network, address, c); err != nil {
+				return err
+			}
+			if control != nil {
+				return control(network, address, c)
+			}
+			return nil
+		}
+	}
+	return d.Dial(network, dst)
 }
 
 func generateCertificate(serverName string) ([]tls.Certificate, error) {
@@ -36,6 +36,7 @@ type SIP003Args struct {
 	SS_PLUGIN_OPTIONS string
 	VPN               bool
 	TFO               bool
+	UDP               bool
 }
 
 func (args *SIP003Args) GetRemoteAddr() string {
@@ -65,6 +66,7 @@ func GetSIP003Args() (*SIP003Args, error) {
 	additional := flag.NewFlagSet("additional", flag.ContinueOnError)
 	tfo := additional.Bool("fast-open", false, "")
 	vpn := additional.Bool("V", false, "")
+	udp := additional.Bool("u", false, "")
 	additional.Parse(os.Args[1:])
 
 	return &SIP003Args{
@@ -76,6 +78,7 @@ func GetSIP003Args() (*SIP003Args, error) {
 
 		TFO: *tfo,
 		VPN: *vpn,
+		UDP: *udp,
 	}, nil
 }
 
@@ -0,0 +1,64 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+//SmuxOptions are optional smux parameters, zero values mean using defaults.
+//SmuxVersion must be the same on client and server.
+type SmuxOptions struct {
+	SmuxVersion           int // 1 or 2, 2 has per-stream flow control
+	SmuxMaxFrameSize      int // bytes, max 65535
+	SmuxMaxReceiveBuffer  int // bytes, of a session
+	SmuxMaxStreamBuffer   int // bytes, of a stream, only used by version 2
+	SmuxKeepAliveInterval time.Duration
+	SmuxKeepAliveTimeout  time.Duration
+}
+
+// newSmuxConfig returns defaultSmuxConfig overwritten by o.
+func (o *SmuxOptions) newSmuxConfig() (*smux.Config, error) {
+	c := defaultSmuxConfig()
+	if o.SmuxVersion != 0 {
+		c.Version = o.SmuxVersion
+	}
+	if o.SmuxMaxFrameSize != 0 {
+		c.MaxFrameSize = o.SmuxMaxFrameSize
+	}
+	if o.SmuxMaxReceiveBuffer != 0 {
+		c.MaxReceiveBuffer = o.SmuxMaxReceiveBuffer
+	}
+	if o.SmuxMaxStreamBuffer != 0 {
+		c.MaxStreamBuffer = o.SmuxMaxStreamBuffer
+	}
+	if o.SmuxKeepAliveInterval != 0 {
+		c.KeepAliveInterval = o.SmuxKeepAliveInterval
+	}
+	if o.SmuxKeepAliveTimeout != 0 {
+		c.KeepAliveTimeout = o.SmuxKeepAliveTimeout
+	}
+	if err := smux.VerifyConfig(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
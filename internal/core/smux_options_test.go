@@ -0,0 +1,133 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+func Test_SmuxOptions_newSmuxConfig(t *testing.T) {
+	c, err := (&SmuxOptions{}).newSmuxConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *c != *defaultSmuxConfig() {
+		t.Fatalf("empty options should use default config, got %+v", c)
+	}
+
+	c, err = (&SmuxOptions{SmuxVersion: 2, SmuxMaxFrameSize: 32 * 1024, SmuxKeepAliveInterval: time.Second, SmuxKeepAliveTimeout: 3 * time.Second}).newSmuxConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version != 2 || c.MaxFrameSize != 32*1024 || c.KeepAliveInterval != time.Second || c.KeepAliveTimeout != 3*time.Second {
+		t.Fatalf("options are not applied, got %+v", c)
+	}
+
+	for _, o := range []SmuxOptions{
+		{SmuxVersion: 3},
+		{SmuxMaxFrameSize: 65536},
+		{SmuxMaxStreamBuffer: 1024 * 1024}, // larger than receive buffer
+		{SmuxKeepAliveInterval: time.Minute, SmuxKeepAliveTimeout: time.Second},
+	} {
+		if _, err := o.newSmuxConfig(); err == nil {
+			t.Errorf("%+v should be invalid", o)
+		}
+	}
+}
+
+func Test_handleClientMuxConn_maxStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	m, err := newMuxer(&SmuxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// echo one byte, then return after reading another one
+	go handleClientMuxConn(m, MuxerSmux, 1, c2, func(c net.Conn, _ *logrus.Entry) {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+		c.Write(b)
+		io.ReadFull(c, b)
+	}, logrus.NewEntry(logrus.StandardLogger()))
+
+	sess, err := m.client(MuxerSmux, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := func(s net.Conn, timeout time.Duration) error {
+		s.SetDeadline(time.Now().Add(timeout))
+		if _, err := s.Write([]byte{1}); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(s, make([]byte, 1))
+		return err
+	}
+
+	// s1 is accepted and active
+	s1, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(s1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the extra stream is rejected. smux may drop the FIN if it comes
+	// before OpenStream returns, so the stream may time out instead of EOF.
+	s2, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(s2, time.Millisecond*200); err != io.EOF && err != smux.ErrTimeout {
+		t.Fatalf("extra stream should be rejected, got %v", err)
+	}
+
+	// after s1 is closed by server, a new stream is accepted
+	s1.Write([]byte{1})
+	if _, err := s1.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("s1 should be closed, got %v", err)
+	}
+	s3, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(s3, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_mux_v2(t *testing.T) {
+	sc, cc := *serverTestConfig, *clientTestConfig
+	sc.EnableWSS = false
+	sc.EnableMux = true
+	sc.SmuxVersion = 2
+	cc.EnableWSS = false
+	cc.EnableMux = true
+	cc.SmuxVersion = 2
+	test(&sc, &cc, t)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// sniRoute is the destination and certificate of a server name.
+type sniRoute struct {
+	dst  string
+	cert *tls.Certificate // nil means using the default one
+}
+
+// sniRoutes maps lower case server names to routes. A name can be a
+// wildcard, e.g. "*.example.com", which matches one label.
+type sniRoutes map[string]*sniRoute
+
+// parseSNIRoutes parses routes, e.g. `a.example.com|127.0.0.1:8001|a.crt|a.key,*.example.com|127.0.0.1:8002`.
+// Routes are separated by ',', and each of them is `ServerName|Dst[|Cert|Key]`.
+func parseSNIRoutes(s string) (sniRoutes, error) {
+	routes := make(sniRoutes)
+	for _, str := range strings.Split(s, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+
+		fields := strings.Split(str, "|")
+		if len(fields) != 2 && len(fields) != 4 {
+			return nil, fmt.Errorf("invalid sni route [%s]", str)
+		}
+		name := strings.ToLower(fields[0])
+		if len(name) == 0 || len(fields[1]) == 0 {
+			return nil, fmt.Errorf("invalid sni route [%s]", str)
+		}
+		if _, ok := routes[name]; ok {
+			return nil, fmt.Errorf("duplicate sni route [%s]", name)
+		}
+
+		r := &sniRoute{dst: fields[1]}
+		if len(fields) == 4 {
+			cer, err := tls.LoadX509KeyPair(fields[2], fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("failed to load key and cert of [%s], %v", name, err)
+			}
+			r.cert = &cer
+		}
+		routes[name] = r
+	}
+	return routes, nil
+}
+
+// match returns the route of serverName, or nil if there is no route.
+// Exact names are preferred to wildcards.
+func (routes sniRoutes) match(serverName string) *sniRoute {
+	serverName = strings.ToLower(serverName)
+	if r, ok := routes[serverName]; ok {
+		return r
+	}
+	if i := strings.IndexByte(serverName, '.'); i > 0 {
+		return routes["*"+serverName[i:]]
+	}
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate. It returns nil
+// if serverName has no certificate, so the default one will be used.
+func (routes sniRoutes) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if r := routes.match(hello.ServerName); r != nil {
+		return r.cert, nil
+	}
+	return nil, nil
+}
+
+// routeDst returns the destination of the connection, which is the route
+// of its server name, or DstAddr if there is no route.
+func (server *Server) routeDst(state *tls.ConnectionState) string {
+	if state != nil {
+		if r := server.sniRoutes.match(state.ServerName); r != nil {
+			return r.dst
+		}
+	}
+	return server.conf.DstAddr
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_sniRoutes_match(t *testing.T) {
+	routes, err := parseSNIRoutes("a.example.com|127.0.0.1:8001, *.example.com|127.0.0.1:8002")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"a.example.com", "127.0.0.1:8001"},
+		{"A.Example.com", "127.0.0.1:8001"},
+		{"b.example.com", "127.0.0.1:8002"},
+		{"example.com", ""},
+		{"a.b.example.com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		var got string
+		if r := routes.match(tt.serverName); r != nil {
+			got = r.dst
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.serverName, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"a.example.com", "|127.0.0.1:8001", "a.example.com|1|2", "a|1,a|2"} {
+		if _, err := parseSNIRoutes(s); err == nil {
+			t.Errorf("%s should be invalid", s)
+		}
+	}
+}
+
+func Test_Server_sniRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, certFile, keyFile := writeTestClientCert(t, dir)
+
+	server, err := NewServer(&ServerConfig{
+		BindAddr:  serverBindAddr,
+		DstAddr:   "127.0.0.1:8000",
+		SNIRoutes: "a.example.com|127.0.0.1:8001|" + certFile + "|" + keyFile + ",b.example.com|127.0.0.1:8002",
+		Timeout:   time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		wantDst    string
+		wantCN     string
+	}{
+		{"a.example.com", "127.0.0.1:8001", "test client"},
+		{"b.example.com", "127.0.0.1:8002", ""},
+		{"c.example.com", "127.0.0.1:8000", ""},
+	}
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		sc := tls.Server(c2, server.tlsConf)
+		go sc.Handshake()
+		cc := tls.Client(c1, &tls.Config{InsecureSkipVerify: true, ServerName: tt.serverName})
+		if err := cc.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if cn := cc.ConnectionState().PeerCertificates[0].Subject.CommonName; tt.wantCN != "" && cn != tt.wantCN {
+			t.Errorf("%s: got certificate %s, want %s", tt.serverName, cn, tt.wantCN)
+		}
+		state := sc.ConnectionState()
+		if dst := server.routeDst(&state); dst != tt.wantDst {
+			t.Errorf("%s: got dst %s, want %s", tt.serverName, dst, tt.wantDst)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
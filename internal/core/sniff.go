@@ -0,0 +1,123 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sniffTimeout is how long server waits for the first bytes of a
+// connection. http, psk, mux and dst header clients send them right after
+// the tls handshake, connections that are silent longer are raw. So clients
+// of server-speaks-first protocols wait this long, unless they enabled psk
+// or mux-alpn.
+const sniffTimeout = time.Second
+
+var httpMethods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE ", "PRI "}
+
+// sniffHTTP reports whether c starts with a http request line, including
+// the http2 connection preface.
+func sniffHTTP(c *bufferedConn) bool {
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	for n := 1; ; n++ {
+		b, err := c.r.Peek(n)
+		if err != nil {
+			return false
+		}
+		isPrefix := false
+		for _, m := range httpMethods {
+			if string(b) == m {
+				return true
+			}
+			if strings.HasPrefix(m, string(b)) {
+				isPrefix = true
+			}
+		}
+		if !isPrefix {
+			return false
+		}
+	}
+}
+
+// sniffRaw reports whether c is a raw tls connection. If psk is set, raw
+// clients always start with a psk preamble, so c is not sniffed as http.
+// Otherwise, connections that don't start with a http request are raw.
+func (server *Server) sniffRaw(c *bufferedConn) bool {
+	if server.pskVerifier == nil {
+		return !sniffHTTP(c)
+	}
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	b, err := c.r.Peek(1)
+	return err == nil && b[0] == pskPreambleVersion
+}
+
+// sniffedConn is a sniffed http connection. It keeps the tls state,
+// because http server can't get it from a wrapped tls connection.
+type sniffedConn struct {
+	*bufferedConn
+	state *tls.ConnectionState
+}
+
+type tlsStateContextKey struct{}
+
+// serveRawAndHTTP accepts connections from server.listener, those start with
+// http requests are served by httpServer, others are handled in raw tls mode.
+// Raw connections that are not tunnel connections are served by httpServer
+// too, which has the fallback.
+func (server *Server) serveRawAndHTTP(httpServer *http.Server) error {
+	httpL := newFallbackListener(server.listener.Addr())
+	defer httpL.Close()
+	var fl *fallbackListener
+	if server.fallback != nil {
+		fl = httpL
+	}
+
+	httpServer.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if sc, ok := c.(*sniffedConn); ok && sc.state != nil {
+			return context.WithValue(ctx, tlsStateContextKey{}, sc.state)
+		}
+		return ctx
+	}
+	h := httpServer.Handler
+	httpServer.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			r.TLS, _ = r.Context().Value(tlsStateContextKey{}).(*tls.ConnectionState)
+		}
+		h.ServeHTTP(w, r)
+	})
+	go httpServer.Serve(httpL)
+
+	for {
+		leftConn, err := server.listener.Accept()
+		if err != nil {
+			return fmt.Errorf("listener.Accept: %v", err)
+		}
+		go server.handleRawConn(leftConn, fl, httpL)
+	}
+}
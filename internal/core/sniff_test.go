@@ -0,0 +1,150 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_sniffHTTP(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{"GET / HTTP/1.1\r\n", true},
+		{"OPTIONS * HTTP/1.1\r\n", true},
+		{"PRI * HTTP/2.0\r\n", true},
+		{"GETX", false},
+		{"\x01\x00\x08\x00", false}, // smux frame
+		{"", false},                 // silent
+	}
+	for _, tt := range tests {
+		c1, c2 := net.Pipe()
+		go c2.Write([]byte(tt.data))
+		bc := newBufferedConn(c1)
+		start := time.Now()
+		if got := sniffHTTP(bc); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.data, got, tt.want)
+		}
+		if len(tt.data) != 0 && time.Since(start) >= sniffTimeout {
+			t.Errorf("%q: sniffing should not wait for timeout", tt.data)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func Test_rawTLS_with_wss(t *testing.T) {
+	sc, cc := *serverTestConfig, *clientTestConfig
+	sc.EnableWSS = true
+	sc.WSSPath = "/"
+	sc.EnableMux = false
+	sc.EnableRawTLS = true
+
+	tests := []struct {
+		name      string
+		wss       bool
+		clientMux bool
+		psk       bool
+	}{
+		{"wss", true, false, false},
+		{"wss mux", true, true, false},
+		{"raw", false, false, false},
+		{"raw mux", false, true, false},
+		{"wss with server psk", true, false, true},
+		{"raw psk", false, false, true},
+		{"raw psk mux", false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc.PSK, cc.PSK = "", ""
+			if tt.psk {
+				sc.PSK = "secret"
+				if !tt.wss {
+					cc.PSK = "secret"
+				}
+			}
+			cc.EnableWSS = tt.wss
+			cc.WSSPath = "/"
+			cc.EnableMux = tt.clientMux
+			test(&sc, &cc, t)
+		})
+	}
+}
+
+func Test_rawTLS_with_wss_fallback(t *testing.T) {
+	tests := []struct {
+		name string
+		psk  string
+		data string
+	}{
+		{"dst header", "", "\x05 not a dst header\r\n\r\n"},
+		{"psk", "secret", "\x01 not a psk preamble" + strings.Repeat(" ", pskPreambleLen) + "\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := NewServer(&ServerConfig{
+				BindAddr:        serverBindAddr,
+				Timeout:         time.Second * 30,
+				EnableWSS:       true,
+				WSSPath:         "/ws",
+				EnableRawTLS:    true,
+				EnableDstHeader: true,
+				PSK:             tt.psk,
+				Fallback:        os.TempDir(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := newDummyDialerListener()
+			go server.ActiveAndServe(l)
+			defer server.Close()
+
+			raw, err := l.connect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+			c := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+			c.SetDeadline(time.Now().Add(time.Second * 5))
+			if _, err := c.Write([]byte(tt.data)); err != nil {
+				t.Fatal(err)
+			}
+
+			// raw connections that are not from clients go to the http
+			// server, it answers the malformed request.
+			resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("want 400, got %s", resp.Status)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// socks5, see RFC 1928 and RFC 1929
+const (
+	socks5Version = 5
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	socks5UserPassVersion = 1
+
+	socks5CmdConnect = 1
+
+	socks5RepSucceeded            = 0x00
+	socks5RepGeneralFailure       = 0x01
+	socks5RepCmdNotSupported      = 0x07
+	socks5RepAddrTypeNotSupported = 0x08
+)
+
+var errSocks5AuthFailed = errors.New("socks5 authentication failed")
+
+// socks5Handshake does the socks5 handshake with a client and returns
+// the requested destination. Only CONNECT is supported. If user is not
+// empty, username/password authentication is required.
+func socks5Handshake(c net.Conn, user, pass string) (dst string, err error) {
+	c.SetDeadline(time.Now().Add(defaultHandShakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	// methods
+	b := make([]byte, 255)
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return "", err
+	}
+	if b[0] != socks5Version {
+		return "", fmt.Errorf("invalid socks version %d", b[0])
+	}
+	methods := b[:b[1]]
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socks5MethodNoAuth)
+	if len(user) != 0 {
+		method = socks5MethodUserPass
+	}
+	accepted := false
+	for _, m := range methods {
+		if m == method {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		c.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return "", errors.New("no acceptable socks5 auth method")
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+
+	if method == socks5MethodUserPass {
+		if err := socks5UserPassAuth(c, user, pass); err != nil {
+			return "", err
+		}
+	}
+
+	// request
+	if _, err := io.ReadFull(c, b[:4]); err != nil {
+		return "", err
+	}
+	if b[0] != socks5Version {
+		return "", fmt.Errorf("invalid socks version %d", b[0])
+	}
+	if b[1] != socks5CmdConnect {
+		socks5Reply(c, socks5RepCmdNotSupported)
+		return "", fmt.Errorf("unsupported socks5 command %d", b[1])
+	}
+	dst, err = readSocksAddr(c, b[3])
+	if err != nil {
+		socks5Reply(c, socks5RepAddrTypeNotSupported)
+		return "", err
+	}
+	return dst, nil
+}
+
+func socks5UserPassAuth(c net.Conn, user, pass string) error {
+	b := make([]byte, 255)
+	if _, err := io.ReadFull(c, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != socks5UserPassVersion {
+		return fmt.Errorf("invalid socks5 username/password auth version %d", b[0])
+	}
+	u := make([]byte, b[1])
+	if _, err := io.ReadFull(c, u); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, b[:1]); err != nil {
+		return err
+	}
+	p := make([]byte, b[0])
+	if _, err := io.ReadFull(c, p); err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(u, []byte(user)) != 1 || subtle.ConstantTimeCompare(p, []byte(pass)) != 1 {
+		c.Write([]byte{socks5UserPassVersion, 1})
+		return errSocks5AuthFailed
+	}
+	_, err := c.Write([]byte{socks5UserPassVersion, 0})
+	return err
+}
+
+// socks5Reply sends a reply with an unspecified bind address.
+func socks5Reply(c net.Conn, rep byte) error {
+	_, err := c.Write([]byte{socks5Version, rep, 0, dstHeaderAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
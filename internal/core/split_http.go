@@ -0,0 +1,598 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// split http transport carries a connection by plain http requests, for
+// CDNs that don't support websocket:
+//
+//	GET  {path}{session id}        a long-lived response for download
+//	POST {path}{session id}/{seq}  upload, the body is the data
+//
+// Uploads can be sent concurrently, server reorders them by seq. Only
+// the download request creates a session, it must be authenticated by
+// client certificate or a psk preamble in the Authorization header.
+const (
+	defaultSplitHTTPPath = "/split/"
+
+	splitHTTPSessionIDLen = 16
+	// max data size in one upload
+	splitHTTPMaxUploadSize = 64 * 1024
+	// max concurrent uploads of a session
+	splitHTTPMaxConcurrentUploads = 4
+	// max out of order uploads server will buffer
+	splitHTTPMaxPendingUploads = 32
+	// max sessions that haven't received any upload
+	splitHTTPMaxPendingSessions = 256
+)
+
+var (
+	errSplitHTTPTooManyUploads  = errors.New("too many pending uploads")
+	errSplitHTTPTooManySessions = errors.New("too many pending sessions")
+	errSplitHTTPSessionExists   = errors.New("session exists")
+)
+
+// splitHTTPClientConn is a connection opened by client.
+type splitHTTPClientConn struct {
+	url       string
+	transport http.RoundTripper
+	ctx       context.Context
+	cancel    context.CancelFunc
+	timeout   time.Duration // max time Close waits for uploads
+
+	body       io.ReadCloser
+	remoteAddr net.Addr
+
+	uploadQueue chan []byte
+	uploadErr   error         // set before closeNotify is closed
+	uploadDone  chan struct{} // closed when uploadLoop returned and all uploads finished
+
+	closingOnce sync.Once
+	closing     chan struct{} // closed by Close, no more writes
+
+	readDeadline, writeDeadline deadlineTimer
+	closeOnce                   sync.Once
+	closeNotify                 chan struct{}
+}
+
+func (client *Client) dialSplitHTTP(s *remoteServer) (net.Conn, error) {
+	sid := make([]byte, splitHTTPSessionIDLen)
+	if _, err := rand.Read(sid); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &splitHTTPClientConn{
+		url:         s.splitHTTPURL + hex.EncodeToString(sid),
+		transport:   s.httpTransport,
+		ctx:         ctx,
+		cancel:      cancel,
+		timeout:     client.conf.Timeout,
+		remoteAddr:  httpAddr(s.addr),
+		uploadQueue: make(chan []byte, splitHTTPMaxConcurrentUploads),
+		uploadDone:  make(chan struct{}),
+		closing:     make(chan struct{}),
+		closeNotify: make(chan struct{}),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if len(client.conf.PSK) != 0 {
+		b, err := newPSKPreamble([]byte(client.conf.PSK), time.Now())
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+base64.RawURLEncoding.EncodeToString(b))
+	}
+	// server sends response header without waiting for client's data
+	timer := time.AfterFunc(defaultHandShakeTimeout, cancel)
+	resp, err := c.transport.RoundTrip(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unexpected http status: %s", resp.Status)
+	}
+
+	c.body = resp.Body
+	c.readDeadline.f = func() { c.closeWithErr(nil) }
+	c.writeDeadline.f = func() { c.closeWithErr(nil) }
+	go c.uploadLoop()
+	return c, nil
+}
+
+// uploadLoop sends data from uploadQueue to server, until c is closed.
+// If c is closing, it sends all queued data and waits for the uploads.
+func (c *splitHTTPClientConn) uploadLoop() {
+	var wg sync.WaitGroup
+	defer close(c.uploadDone)
+	defer wg.Wait()
+
+	sem := make(chan struct{}, splitHTTPMaxConcurrentUploads)
+	var next []byte // data that can't be merged into the previous upload
+	for seq := uint64(0); ; seq++ {
+		data := next
+		next = nil
+		if data == nil {
+			select {
+			case data = <-c.uploadQueue:
+			case <-c.closing:
+				select {
+				case data = <-c.uploadQueue:
+				default:
+					return
+				}
+			case <-c.closeNotify:
+				return
+			}
+		}
+		// merge queued data
+	merge:
+		for next == nil {
+			select {
+			case b := <-c.uploadQueue:
+				if len(data)+len(b) > splitHTTPMaxUploadSize {
+					next = b
+				} else {
+					data = append(data, b...)
+				}
+			default:
+				break merge
+			}
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-c.closeNotify:
+			return
+		}
+		wg.Add(1)
+		go func(seq uint64, data []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := c.upload(seq, data); err != nil {
+				c.closeWithErr(err)
+			}
+		}(seq, data)
+	}
+}
+
+func (c *splitHTTPClientConn) upload(seq uint64, data []byte) error {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url+"/"+strconv.FormatUint(seq, 10), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload: unexpected http status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *splitHTTPClientConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *splitHTTPClientConn) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		data := b
+		if len(data) > splitHTTPMaxUploadSize {
+			data = data[:splitHTTPMaxUploadSize]
+		}
+		select {
+		case <-c.closing:
+			return n, io.ErrClosedPipe
+		default:
+		}
+		select {
+		case c.uploadQueue <- append([]byte(nil), data...):
+		case <-c.closing:
+			return n, io.ErrClosedPipe
+		case <-c.closeNotify:
+			if c.uploadErr != nil {
+				return n, c.uploadErr
+			}
+			return n, io.ErrClosedPipe
+		}
+		n += len(data)
+		b = b[len(data):]
+	}
+	return n, nil
+}
+
+func (c *splitHTTPClientConn) closeWithErr(err error) {
+	c.closeOnce.Do(func() {
+		c.uploadErr = err
+		close(c.closeNotify)
+		c.readDeadline.set(time.Time{})
+		c.writeDeadline.set(time.Time{})
+		c.body.Close()
+		c.cancel()
+	})
+}
+
+// Close waits for queued and in-flight uploads for at most c.timeout,
+// then closes c. It returns the upload error, if any.
+func (c *splitHTTPClientConn) Close() error {
+	c.closingOnce.Do(func() { close(c.closing) })
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case <-c.uploadDone:
+	case <-c.closeNotify:
+	case <-timer.C:
+		c.closeWithErr(errors.New("upload: timeout on close"))
+	}
+	c.closeWithErr(nil)
+	return c.uploadErr
+}
+
+func (c *splitHTTPClientConn) LocalAddr() net.Addr  { return httpAddr("") }
+func (c *splitHTTPClientConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *splitHTTPClientConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *splitHTTPClientConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *splitHTTPClientConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// splitHTTPSession is a connection accepted by server. Server reads and
+// writes the tunnel end of a pipe, and http handlers read and write the
+// other end.
+type splitHTTPSession struct {
+	tunnelConn, httpConn net.Conn
+
+	mu          sync.Mutex
+	nextSeq     uint64
+	pending     map[uint64][]byte
+	downloading bool
+
+	uploaded bool // guarded by splitHTTPSessions
+
+	writeMu   sync.Mutex // serializes writes to httpConn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newSplitHTTPSession() *splitHTTPSession {
+	tunnelConn, httpConn := net.Pipe()
+	return &splitHTTPSession{
+		tunnelConn: tunnelConn,
+		httpConn:   httpConn,
+		pending:    make(map[uint64][]byte),
+		closed:     make(chan struct{}),
+	}
+}
+
+// upload writes data to the tunnel by seq order. Data that comes before
+// its previous ones will be written by the upload that fills the gap.
+func (s *splitHTTPSession) upload(seq uint64, data []byte) error {
+	s.mu.Lock()
+	if _, dup := s.pending[seq]; seq < s.nextSeq || dup {
+		s.mu.Unlock()
+		return fmt.Errorf("duplicated upload %d", seq)
+	}
+	if seq-s.nextSeq >= splitHTTPMaxPendingUploads {
+		s.mu.Unlock()
+		return errSplitHTTPTooManyUploads
+	}
+	s.pending[seq] = data
+	s.mu.Unlock()
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	for {
+		s.mu.Lock()
+		b, ok := s.pending[s.nextSeq]
+		if ok {
+			delete(s.pending, s.nextSeq)
+			s.nextSeq++
+		}
+		s.mu.Unlock()
+
+		if !ok {
+			return nil
+		}
+		if _, err := s.httpConn.Write(b); err != nil {
+			return err
+		}
+	}
+}
+
+// download copies data from the tunnel to w until the session is closed.
+func (s *splitHTTPSession) download(w http.ResponseWriter) error {
+	s.mu.Lock()
+	if s.downloading {
+		s.mu.Unlock()
+		return errors.New("session is downloading")
+	}
+	s.downloading = true
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+
+	buf := acquireIOBuf()
+	defer releaseIOBuf(buf)
+	for {
+		n, err := s.httpConn.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (s *splitHTTPSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.httpConn.Close()
+		s.tunnelConn.Close()
+	})
+}
+
+// splitHTTPSessions are split http sessions of a server.
+type splitHTTPSessions struct {
+	sync.Mutex
+	m       map[string]*splitHTTPSession
+	pending int // sessions that haven't received any upload
+}
+
+// add adds s as sid. It fails if sid exists or there are too many
+// pending sessions.
+func (ss *splitHTTPSessions) add(sid string, s *splitHTTPSession) error {
+	ss.Lock()
+	defer ss.Unlock()
+	if _, ok := ss.m[sid]; ok {
+		return errSplitHTTPSessionExists
+	}
+	if ss.pending >= splitHTTPMaxPendingSessions {
+		return errSplitHTTPTooManySessions
+	}
+	ss.m[sid] = s
+	ss.pending++
+	return nil
+}
+
+// getForUpload returns the session of sid, or nil if it doesn't exist.
+// The session is not pending anymore.
+func (ss *splitHTTPSessions) getForUpload(sid string) *splitHTTPSession {
+	ss.Lock()
+	defer ss.Unlock()
+	s, ok := ss.m[sid]
+	if ok && !s.uploaded {
+		s.uploaded = true
+		ss.pending--
+	}
+	return s
+}
+
+func (ss *splitHTTPSessions) remove(sid string, s *splitHTTPSession) {
+	ss.Lock()
+	defer ss.Unlock()
+	if ss.m[sid] != s {
+		return
+	}
+	delete(ss.m, sid)
+	if !s.uploaded {
+		ss.pending--
+	}
+}
+
+// splitHTTPAuthed reports whether r is from a client. If psk is set, r
+// must have a valid psk preamble.
+func (server *Server) splitHTTPAuthed(r *http.Request) bool {
+	if !server.clientAuthed(r.TLS) {
+		return false
+	}
+	if server.pskVerifier == nil {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(auth[len("Bearer "):])
+	if err != nil {
+		return false
+	}
+	return server.pskVerifier.verify(b, time.Now()) == nil
+}
+
+// serveSplitHTTP handles split http requests from clients.
+func (server *Server) serveSplitHTTP(w http.ResponseWriter, r *http.Request) {
+	requestEntry := logrus.WithField("http_client", r.RemoteAddr)
+	notTunnel := func() {
+		if server.fallback != nil {
+			requestEntry.Debug("not a tunnel request, fallback")
+			server.fallback.ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+	}
+
+	sid, seq, isUpload, ok := parseSplitHTTPPath(strings.TrimPrefix(r.URL.Path, server.conf.SplitHTTPPath))
+	if !ok || isUpload != (r.Method == http.MethodPost) || !isUpload && r.Method != http.MethodGet ||
+		!server.clientAuthed(r.TLS) {
+		notTunnel()
+		return
+	}
+
+	if isUpload {
+		// the session id is only known by the client that created it
+		s := server.splitHTTPSessions.getForUpload(sid)
+		if s == nil {
+			notTunnel()
+			return
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, splitHTTPMaxUploadSize+1))
+		if err == nil && len(data) > splitHTTPMaxUploadSize {
+			err = errors.New("upload is too large")
+		}
+		if err == nil {
+			err = s.upload(seq, data)
+		}
+		if err != nil {
+			requestEntry.Warnf("split http upload, %v", err)
+			s.close()
+			http.Error(w, "", http.StatusBadRequest)
+		}
+		return
+	}
+
+	if !server.splitHTTPAuthed(r) {
+		requestEntry.Warn("split http session is not authenticated")
+		notTunnel()
+		return
+	}
+	s, err := server.newSplitHTTPSession(sid, server.routeDst(r.TLS), requestEntry)
+	if err != nil {
+		requestEntry.Warnf("split http session, %v", err)
+		if err == errSplitHTTPTooManySessions {
+			http.Error(w, "", http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, "", http.StatusBadRequest)
+		}
+		return
+	}
+
+	requestEntry.Debug("split http session accepted")
+	// client closed the download
+	go func() {
+		select {
+		case <-r.Context().Done():
+			s.close()
+		case <-s.closed:
+		}
+	}()
+	if err := s.download(w); err != nil {
+		requestEntry.Debugf("split http download, %v", err)
+	}
+	s.close()
+}
+
+// newSplitHTTPSession creates a new session, which connects to dst.
+func (server *Server) newSplitHTTPSession(sid, dst string, requestEntry *logrus.Entry) (*splitHTTPSession, error) {
+	s := newSplitHTTPSession()
+	if err := server.splitHTTPSessions.add(sid, s); err != nil {
+		return nil, err
+	}
+	go func() {
+		defer func() {
+			s.close()
+			server.splitHTTPSessions.remove(sid, s)
+		}()
+
+		if server.conf.EnableMux {
+			server.handleClientMuxConn(s.tunnelConn, "", dst, requestEntry)
+		} else {
+			server.handleClientConn(s.tunnelConn, dst, requestEntry)
+		}
+	}()
+	return s, nil
+}
+
+// parseSplitHTTPPath parses "{session id}" or "{session id}/{seq}".
+func parseSplitHTTPPath(p string) (sid string, seq uint64, isUpload bool, ok bool) {
+	sid = p
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		var err error
+		if seq, err = strconv.ParseUint(p[i+1:], 10, 64); err != nil {
+			return "", 0, false, false
+		}
+		sid, isUpload = p[:i], true
+	}
+	if b, err := hex.DecodeString(sid); err != nil || len(b) != splitHTTPSessionIDLen {
+		return "", 0, false, false
+	}
+	return sid, seq, isUpload, true
+}
+
+// normalizeSplitHTTPPath returns p with a leading and a trailing "/".
+func normalizeSplitHTTPPath(p string) string {
+	if len(p) == 0 {
+		return defaultSplitHTTPPath
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	if !strings.HasSuffix(p, "/") {
+		p = p + "/"
+	}
+	return p
+}
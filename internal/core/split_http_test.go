@@ -0,0 +1,222 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_splitHTTPSession_upload(t *testing.T) {
+	s := newSplitHTTPSession()
+	defer s.close()
+
+	got := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(s.tunnelConn)
+		got <- b
+	}()
+
+	// out of order uploads
+	for _, seq := range []uint64{2, 0, 3, 1} {
+		if err := s.upload(seq, []byte{byte(seq)}); err != nil {
+			t.Fatalf("upload %d: %v", seq, err)
+		}
+	}
+	if err := s.upload(1, []byte{1}); err == nil {
+		t.Fatal("duplicated upload should fail")
+	}
+	if err := s.upload(4+splitHTTPMaxPendingUploads, []byte{0}); err != errSplitHTTPTooManyUploads {
+		t.Fatalf("want errSplitHTTPTooManyUploads, got %v", err)
+	}
+
+	s.httpConn.Close()
+	if b := <-got; !bytes.Equal(b, []byte{0, 1, 2, 3}) {
+		t.Fatalf("data err, got %v", b)
+	}
+}
+
+func Test_parseSplitHTTPPath(t *testing.T) {
+	sid := "00112233445566778899aabbccddeeff"
+	tests := []struct {
+		p        string
+		seq      uint64
+		isUpload bool
+		ok       bool
+	}{
+		{sid, 0, false, true},
+		{sid + "/12", 12, true, true},
+		{sid + "/", 0, false, false},
+		{sid + "/a", 0, false, false},
+		{sid[2:], 0, false, false},
+		{"", 0, false, false},
+	}
+	for _, tt := range tests {
+		gotSid, seq, isUpload, ok := parseSplitHTTPPath(tt.p)
+		if ok != tt.ok || ok && (gotSid != sid || seq != tt.seq || isUpload != tt.isUpload) {
+			t.Errorf("parseSplitHTTPPath(%s) = %s, %d, %v, %v", tt.p, gotSid, seq, isUpload, ok)
+		}
+	}
+}
+
+func Test_splitHTTP(t *testing.T) {
+	sc, cc := *serverTestConfig, *clientTestConfig
+	sc.EnableWSS = false
+	sc.EnableSplitHTTP = true
+	sc.PSK = "secret"
+	cc.EnableWSS = false
+	cc.EnableSplitHTTP = true
+	cc.PSK = "secret"
+
+	sc.EnableMux = false
+	cc.EnableMux = false
+	test(&sc, &cc, t)
+
+	sc.EnableMux = true
+	cc.EnableMux = true
+	test(&sc, &cc, t)
+}
+
+func Test_splitHTTPClientConn_Close(t *testing.T) {
+	var mu sync.Mutex
+	uploads := make(map[uint64][]byte)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, seq, isUpload, ok := parseSplitHTTPPath(strings.TrimPrefix(r.URL.Path, defaultSplitHTTPPath))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !isUpload {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		time.Sleep(time.Millisecond * 50) // keep uploads in flight when Close is called
+		mu.Lock()
+		uploads[seq] = b
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	client := &Client{conf: &ClientConfig{Timeout: time.Second * 5}}
+	s := &remoteServer{splitHTTPURL: ts.URL + defaultSplitHTTPPath, httpTransport: ts.Client().Transport.(*http.Transport)}
+	c, err := client.dialSplitHTTP(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, splitHTTPMaxUploadSize*10+1)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	got := make([]byte, 0, len(data))
+	for seq := uint64(0); seq < uint64(len(uploads)); seq++ {
+		got = append(got, uploads[seq]...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("server got %d bytes in %d uploads, want %d bytes", len(got), len(uploads), len(data))
+	}
+}
+
+func Test_Server_serveSplitHTTP_auth(t *testing.T) {
+	if _, err := NewServer(&ServerConfig{BindAddr: serverBindAddr, DstAddr: dstAddr, Timeout: time.Second, EnableSplitHTTP: true}); err == nil {
+		t.Fatal("split http without psk or client-ca should fail")
+	}
+
+	server, err := NewServer(&ServerConfig{BindAddr: serverBindAddr, DstAddr: dstAddr, Timeout: time.Second, EnableSplitHTTP: true, PSK: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid := "00112233445566778899aabbccddeeff"
+	b, err := newPSKPreamble([]byte("wrong"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+	}{
+		{"download without psk", http.MethodGet, sid, ""},
+		{"download with wrong psk", http.MethodGet, sid, "Bearer " + base64.RawURLEncoding.EncodeToString(b)},
+		{"upload to unknown session", http.MethodPost, sid + "/0", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, defaultSplitHTTPPath+tt.path, strings.NewReader("data"))
+		if len(tt.auth) != 0 {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		server.serveSplitHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: want 404, got %d", tt.name, w.Code)
+		}
+	}
+	if len(server.splitHTTPSessions.m) != 0 {
+		t.Fatal("session should not be created")
+	}
+}
+
+func Test_splitHTTPSessions_pending(t *testing.T) {
+	ss := splitHTTPSessions{m: make(map[string]*splitHTTPSession)}
+	for i := 0; i < splitHTTPMaxPendingSessions; i++ {
+		if err := ss.add(strconv.Itoa(i), newSplitHTTPSession()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ss.add("0", newSplitHTTPSession()); err != errSplitHTTPSessionExists {
+		t.Fatalf("want errSplitHTTPSessionExists, got %v", err)
+	}
+	if err := ss.add("new", newSplitHTTPSession()); err != errSplitHTTPTooManySessions {
+		t.Fatalf("want errSplitHTTPTooManySessions, got %v", err)
+	}
+
+	// uploaded and removed sessions are not pending
+	ss.getForUpload("0")
+	ss.remove("1", ss.m["1"])
+	for _, sid := range []string{"new", "new2"} {
+		if err := ss.add(sid, newSplitHTTPSession()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ss.getForUpload("unknown") != nil {
+		t.Fatal("unknown session should be nil")
+	}
+}
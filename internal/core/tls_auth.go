@@ -0,0 +1,127 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+//client certificate verification modes
+const (
+	ClientAuthRequire  = "require"
+	ClientAuthOptional = "optional"
+)
+
+// setClientAuth makes tlsConf verify client certificates with the CA bundle
+// caFile. An empty mode means ClientAuthRequire. If caFile is empty,
+// tlsConf won't request client certificates.
+func setClientAuth(tlsConf *tls.Config, caFile, mode string) error {
+	if len(caFile) == 0 {
+		if len(mode) != 0 {
+			return errors.New("client auth needs a client CA")
+		}
+		return nil
+	}
+
+	switch mode {
+	case "", ClientAuthRequire:
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthOptional:
+		tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("unknown client auth mode [%s]", mode)
+	}
+
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return err
+	}
+	tlsConf.ClientCAs = pool
+	return nil
+}
+
+// loadCertPool loads a PEM encoded CA bundle.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no valid certificate in %s", caFile)
+	}
+	return pool, nil
+}
+
+// certPins is a set of SHA-256 SubjectPublicKeyInfo pins.
+type certPins map[string]bool
+
+// parseCertPins parses base64 encoded pins separated by ','. The
+// "sha256/" prefix used by HPKP is allowed.
+func parseCertPins(s string) (certPins, error) {
+	pins := make(certPins)
+	for _, str := range strings.Split(s, ",") {
+		str = strings.TrimPrefix(strings.TrimSpace(str), "sha256/")
+		if len(str) == 0 {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(str)
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin [%s]", str)
+		}
+		pins[str] = true
+	}
+	if len(pins) == 0 {
+		return nil, errors.New("no pin")
+	}
+	return pins, nil
+}
+
+// certPin returns the pin of cert.
+func certPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// verifyConnection can be used as tls.Config.VerifyConnection. If the
+// certificate chains were verified, it passes if any certificate in them
+// matches a pin. Otherwise, only the leaf certificate is checked, because
+// other certificates sent by the peer are not bound to its key.
+func (pins certPins) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) != 0 {
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				if pins[certPin(cert)] {
+					return nil
+				}
+			}
+		}
+	} else if len(cs.PeerCertificates) != 0 && pins[certPin(cs.PeerCertificates[0])] {
+		return nil
+	}
+	return errors.New("no certificate matches the pins")
+}
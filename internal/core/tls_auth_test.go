@@ -0,0 +1,276 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestClientCert generates a CA and a client cert signed by it, and
+// writes them to dir.
+func writeTestClientCert(t *testing.T, dir string) (caFile, certFile, keyFile string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile = filepath.Join(dir, "ca.pem")
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client.key")
+	files := map[string]*pem.Block{
+		caFile:   {Type: "CERTIFICATE", Bytes: caDER},
+		certFile: {Type: "CERTIFICATE", Bytes: certDER},
+		keyFile:  {Type: "PRIVATE KEY", Bytes: keyDER},
+	}
+	for f, b := range files {
+		if err := ioutil.WriteFile(f, pem.EncodeToMemory(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return caFile, certFile, keyFile
+}
+
+func Test_clientAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile, certFile, keyFile := writeTestClientCert(t, dir)
+
+	clientWithCert, err := NewClient(&ClientConfig{
+		BindAddr:           clientBindAddr,
+		RemoteAddr:         serverBindAddr,
+		Timeout:            time.Second * 30,
+		MuxMaxStream:       4,
+		InsecureSkipVerify: true,
+		ClientCert:         certFile,
+		ClientKey:          keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientNoCert, err := NewClient(&ClientConfig{
+		BindAddr:           clientBindAddr,
+		RemoteAddr:         serverBindAddr,
+		Timeout:            time.Second * 30,
+		MuxMaxStream:       4,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		mode    string
+		client  *Client
+		wantErr bool
+	}{
+		{"require with cert", ClientAuthRequire, clientWithCert, false},
+		{"require without cert", ClientAuthRequire, clientNoCert, true},
+		{"optional with cert", ClientAuthOptional, clientWithCert, false},
+		{"optional without cert", ClientAuthOptional, clientNoCert, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := NewServer(&ServerConfig{
+				BindAddr:   serverBindAddr,
+				DstAddr:    dstAddr,
+				Timeout:    time.Second * 30,
+				ClientCA:   caFile,
+				ClientAuth: tt.mode,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			tlsServer := tls.Server(s, server.tlsConf)
+			go func() {
+				tlsServer.Handshake()
+				s.Close()
+			}()
+
+			tlsClient := tls.Client(c, tt.client.balancer.servers[0].tlsConf)
+			tlsClient.SetDeadline(time.Now().Add(time.Second * 5))
+			err = tlsClient.Handshake()
+			if err == nil {
+				// TLS 1.3 client finishes its handshake before the server
+				// verifies its cert, the server's alert comes with the first read.
+				// If the server accepted the cert, it just closes the conn.
+				if _, err = tlsClient.Read(make([]byte, 1)); err == io.EOF {
+					err = nil
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handshake err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := NewServer(&ServerConfig{BindAddr: serverBindAddr, DstAddr: dstAddr, Timeout: time.Second, ClientAuth: ClientAuthRequire}); err == nil {
+		t.Fatal("client auth without CA should fail")
+	}
+	if _, err := NewServer(&ServerConfig{BindAddr: serverBindAddr, DstAddr: dstAddr, Timeout: time.Second, ClientCA: caFile, DisableTLS: true}); err == nil {
+		t.Fatal("client auth with disable-tls should fail")
+	}
+}
+
+func Test_certPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cers, err := generateCertificate("mtt.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cers[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "server.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	otherCers, err := generateCertificate("mtt.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherLeaf, err := x509.ParseCertificate(otherCers[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCAFile := filepath.Join(dir, "other.pem")
+	if err := ioutil.WriteFile(otherCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherLeaf.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a MITM sends its own leaf, with the pinned certificate as an extra chain certificate
+	injected := otherCers[0]
+	injected.Certificate = [][]byte{otherLeaf.Raw, leaf.Raw}
+
+	tests := []struct {
+		name     string
+		ca       string
+		pins     string
+		injected bool
+		wantErr  bool
+	}{
+		{"no ca no pin", "", "", false, true},
+		{"pin", "", certPin(leaf), false, false},
+		{"pin with prefix", "", "sha256/" + certPin(leaf), false, false},
+		{"wrong pin", "", certPin(otherLeaf), false, true},
+		{"one of pins", "", certPin(otherLeaf) + "," + certPin(leaf), false, false},
+		{"ca", caFile, "", false, false},
+		{"ca and pin", caFile, certPin(leaf), false, false},
+		{"ca and wrong pin", caFile, certPin(otherLeaf), false, true},
+		{"injected pin", "", certPin(leaf), true, true},
+		{"injected pin not in verified chain", otherCAFile, certPin(leaf), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClient(&ClientConfig{
+				BindAddr:     clientBindAddr,
+				RemoteAddr:   serverBindAddr,
+				ServerName:   "mtt.test",
+				Timeout:      time.Second * 30,
+				MuxMaxStream: 4,
+				CA:           tt.ca,
+				CertPins:     tt.pins,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c, s := net.Pipe()
+			defer c.Close()
+			defer s.Close()
+			serverCers := cers
+			if tt.injected {
+				serverCers = []tls.Certificate{injected}
+			}
+			go tls.Server(s, &tls.Config{Certificates: serverCers}).Handshake()
+
+			tlsClient := tls.Client(c, client.balancer.servers[0].tlsConf)
+			tlsClient.SetDeadline(time.Now().Add(time.Second * 5))
+			err = tlsClient.Handshake()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handshake err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := parseCertPins("not a pin"); err == nil {
+		t.Fatal("invalid pin should fail")
+	}
+}
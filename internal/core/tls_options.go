@@ -0,0 +1,154 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+//TLSOptions are optional tls parameters, lists are separated by ','.
+//Empty means using Go's default.
+type TLSOptions struct {
+	TLSMinVersion string // "1.0", "1.1", "1.2" or "1.3"
+	TLSMaxVersion string
+	// TLSCipherSuites are IANA names of cipher suites, e.g. "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256".
+	// TLS 1.3 cipher suites are not configurable.
+	TLSCipherSuites string
+	TLSCurves       string // "X25519", "P256", "P384" or "P521"
+	ALPN            string // e.g. "h2,http/1.1"
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// apply sets the parameters in o to conf.
+func (o *TLSOptions) apply(conf *tls.Config) error {
+	var err error
+	if conf.MinVersion, err = parseTLSVersion(o.TLSMinVersion); err != nil {
+		return err
+	}
+	if conf.MaxVersion, err = parseTLSVersion(o.TLSMaxVersion); err != nil {
+		return err
+	}
+	if conf.MinVersion != 0 && conf.MaxVersion != 0 && conf.MinVersion > conf.MaxVersion {
+		return fmt.Errorf("tls min version %s is higher than max version %s", o.TLSMinVersion, o.TLSMaxVersion)
+	}
+
+	for _, name := range splitList(o.TLSCipherSuites) {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return fmt.Errorf("unknown cipher suite [%s]", name)
+		}
+		conf.CipherSuites = append(conf.CipherSuites, id)
+	}
+
+	for _, name := range splitList(o.TLSCurves) {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("unknown curve [%s]", name)
+		}
+		conf.CurvePreferences = append(conf.CurvePreferences, id)
+	}
+
+	conf.NextProtos = splitList(o.ALPN)
+	return nil
+}
+
+// removeH2 returns a copy of protos without "h2". Websocket needs HTTP/1.1,
+// so servers can't negotiate "h2" with clients in wss mode. protos is not
+// modified, it may be shared by cloned tls configs.
+func removeH2(protos []string) []string {
+	l := make([]string, 0, len(protos))
+	for _, p := range protos {
+		if p != "h2" {
+			l = append(l, p)
+		}
+	}
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// addH2 adds "h2" to protos, which is needed by grpc.
+func addH2(protos []string) []string {
+	if len(protos) == 0 {
+		return []string{"h2", "http/1.1"}
+	}
+	for _, p := range protos {
+		if p == "h2" {
+			return protos
+		}
+	}
+	return append([]string{"h2"}, protos...)
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version [%s]", s)
+	}
+	return v, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, s := range tls.CipherSuites() {
+		if s.Name == name {
+			return s.ID, true
+		}
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		if s.Name == name {
+			return s.ID, true
+		}
+	}
+	return 0, false
+}
+
+// splitList splits a list separated by ',' and drops empty elements.
+func splitList(s string) []string {
+	l := make([]string, 0)
+	for _, str := range strings.Split(s, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) != 0 {
+			l = append(l, str)
+		}
+	}
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func Test_TLSOptions_apply(t *testing.T) {
+	tests := []struct {
+		name    string
+		o       TLSOptions
+		want    *tls.Config
+		wantErr bool
+	}{
+		{"empty", TLSOptions{}, &tls.Config{}, false},
+		{"versions", TLSOptions{TLSMinVersion: "1.2", TLSMaxVersion: "1.3"},
+			&tls.Config{MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS13}, false},
+		{"min > max", TLSOptions{TLSMinVersion: "1.3", TLSMaxVersion: "1.2"}, nil, true},
+		{"unknown version", TLSOptions{TLSMinVersion: "1.4"}, nil, true},
+		{"cipher suites", TLSOptions{TLSCipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			&tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}, false},
+		{"unknown cipher suite", TLSOptions{TLSCipherSuites: "TLS_FOO"}, nil, true},
+		{"curves", TLSOptions{TLSCurves: "X25519,P256"},
+			&tls.Config{CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256}}, false},
+		{"unknown curve", TLSOptions{TLSCurves: "P999"}, nil, true},
+		{"alpn", TLSOptions{ALPN: "h2,http/1.1,"}, &tls.Config{NextProtos: []string{"h2", "http/1.1"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := new(tls.Config)
+			err := tt.o.apply(conf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(conf, tt.want) {
+				t.Fatalf("apply() = %+v, want %+v", conf, tt.want)
+			}
+		})
+	}
+}
+
+func Test_wss_alpn(t *testing.T) {
+	o := TLSOptions{TLSMinVersion: "1.3", ALPN: "h2,http/1.1"}
+	serverTestConfig.EnableWSS = true
+	serverTestConfig.WSSPath = "/"
+	serverTestConfig.EnableMux = false
+	serverTestConfig.TLSOptions = o
+	clientTestConfig.EnableWSS = true
+	clientTestConfig.WSSPath = "/"
+	clientTestConfig.EnableMux = false
+	clientTestConfig.TLSOptions = o
+	defer func() {
+		serverTestConfig.TLSOptions = TLSOptions{}
+		clientTestConfig.TLSOptions = TLSOptions{}
+	}()
+	test(serverTestConfig, clientTestConfig, t)
+}
+
+func Test_removeH2(t *testing.T) {
+	base := &tls.Config{NextProtos: []string{"h2", "a", "h2", "b"}}
+	for i := 0; i < 2; i++ {
+		c := base.Clone()
+		c.NextProtos = removeH2(c.NextProtos)
+		if !reflect.DeepEqual(c.NextProtos, []string{"a", "b"}) {
+			t.Fatalf("got %v", c.NextProtos)
+		}
+	}
+	if !reflect.DeepEqual(base.NextProtos, []string{"h2", "a", "h2", "b"}) {
+		t.Fatalf("base config is modified: %v", base.NextProtos)
+	}
+	if removeH2([]string{"h2"}) != nil {
+		t.Fatal("want nil")
+	}
+}
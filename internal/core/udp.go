@@ -0,0 +1,294 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udp over stream: every datagram is sent as a frame with a 2 bytes
+// big-endian length prefix.
+//
+//	+--------+----------+
+//	| LENGTH | DATAGRAM |
+//	+--------+----------+
+//	|   2    | Variable |
+//	+--------+----------+
+const (
+	maxUDPDatagramSize = 65535
+
+	udpSessionCheckInterval = time.Second * 5
+	udpSessionQueueSize     = 64
+)
+
+var udpBufPool = &sync.Pool{New: func() interface{} {
+	return make([]byte, 2+maxUDPDatagramSize)
+}}
+
+func writeUDPFrame(w io.Writer, b []byte) error {
+	if len(b) > maxUDPDatagramSize {
+		return fmt.Errorf("datagram is too large: %d", len(b))
+	}
+
+	buf := udpBufPool.Get().([]byte)
+	defer udpBufPool.Put(buf)
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	n := copy(buf[2:], b)
+
+	// write in one call, so a frame won't be split into multiple websocket messages
+	_, err := w.Write(buf[:2+n])
+	return err
+}
+
+// readUDPFrame reads a frame from r into b, b must be large enough
+// to hold a maxUDPDatagramSize datagram.
+func readUDPFrame(r io.Reader, b []byte) (int, error) {
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(r, b[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// relayUDP relays datagrams between stream and a connected udp conn
+// until one of them is closed, or both directions are idle for timeout.
+// Read deadlines are not used, because a timeout in the middle of a frame
+// breaks the stream, and it closes some streams, e.g. grpc.
+func relayUDP(stream, udpConn net.Conn, timeout time.Duration) error {
+	fe := firstErr{}
+	lastActive := time.Now().UnixNano()
+	touch := func() { atomic.StoreInt64(&lastActive, time.Now().UnixNano()) }
+	var idleClosed int32
+	closeBoth := func() {
+		udpConn.Close()
+		stream.Close()
+	}
+	// ignore errors caused by closeBoth
+	report := func(err error) {
+		if err == io.EOF || atomic.LoadInt32(&idleClosed) == 1 {
+			err = nil
+		}
+		fe.report(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() { // close both on idle
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				if d := timeout - time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))); d > 0 {
+					timer.Reset(d)
+					continue
+				}
+				atomic.StoreInt32(&idleClosed, 1)
+				closeBoth()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() { // stream -> udp
+		defer wg.Done()
+		defer closeBoth()
+		buf := udpBufPool.Get().([]byte)
+		defer udpBufPool.Put(buf)
+		for {
+			n, err := readUDPFrame(stream, buf)
+			if err != nil {
+				report(err)
+				return
+			}
+			touch()
+			if _, err := udpConn.Write(buf[:n]); err != nil {
+				report(err)
+				return
+			}
+		}
+	}()
+
+	func() { // udp -> stream
+		defer closeBoth()
+		buf := udpBufPool.Get().([]byte)
+		defer udpBufPool.Put(buf)
+		for {
+			n, err := udpConn.Read(buf)
+			if err != nil {
+				report(err)
+				return
+			}
+			touch()
+			stream.SetWriteDeadline(time.Now().Add(timeout))
+			err = writeUDPFrame(stream, buf[:n])
+			stream.SetWriteDeadline(time.Time{})
+			if err != nil {
+				report(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	return fe.getErr()
+}
+
+// udpSession is a client side udp session of a source address.
+type udpSession struct {
+	queue      chan []byte
+	closeOnce  sync.Once
+	closed     chan struct{}
+	lastActive int64 // atomic, unix nano
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive))) > timeout
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+// serveUDP reads datagrams from pc, and sends them to server. Each source
+// address has its own session (tunnel stream), sessions will be closed if
+// they are idle for UDPTimeout.
+func (client *Client) serveUDP(pc net.PacketConn) error {
+	mu := sync.Mutex{}
+	sessions := make(map[string]*udpSession)
+
+	// close idle sessions
+	go func() {
+		ticker := time.NewTicker(udpSessionCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-client.closeNotify:
+				return
+			}
+			mu.Lock()
+			for key, sess := range sessions {
+				if sess.idle(client.conf.UDPTimeout) {
+					sess.close()
+					delete(sessions, key)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, maxUDPDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return fmt.Errorf("udp ReadFrom: %v", err)
+		}
+
+		key := addr.String()
+		mu.Lock()
+		sess, ok := sessions[key]
+		if !ok {
+			sess = &udpSession{queue: make(chan []byte, udpSessionQueueSize), closed: make(chan struct{})}
+			sess.touch()
+			sessions[key] = sess
+
+			go func() {
+				client.log.Debugf("udp session from %s opened", key)
+				err := client.handleUDPSession(pc, addr, sess)
+				if err != nil {
+					client.log.Errorf("udp session from %s: %v", key, err)
+				}
+				sess.close()
+				mu.Lock()
+				if sessions[key] == sess {
+					delete(sessions, key)
+				}
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		select {
+		case sess.queue <- b:
+		default:
+			client.log.Warnf("udp session from %s is busy, datagram dropped", key)
+		}
+	}
+}
+
+func (client *Client) handleUDPSession(pc net.PacketConn, addr net.Addr, sess *udpSession) error {
+	stream, err := client.openServerConn(dstHeaderCmdUDP, "")
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	go func() { // server -> local
+		defer sess.close()
+		buf := udpBufPool.Get().([]byte)
+		defer udpBufPool.Put(buf)
+		for {
+			n, err := readUDPFrame(stream, buf)
+			if err != nil {
+				return
+			}
+			sess.touch()
+			if _, err := pc.WriteTo(buf[:n], addr); err != nil {
+				client.log.Warnf("udp WriteTo %s: %v", addr, err)
+				return
+			}
+		}
+	}()
+
+	for { // local -> server
+		select {
+		case b := <-sess.queue:
+			sess.touch()
+			stream.SetWriteDeadline(time.Now().Add(client.conf.Timeout))
+			err := writeUDPFrame(stream, b)
+			stream.SetWriteDeadline(time.Time{})
+			if err != nil {
+				return fmt.Errorf("write udp frame: %v", err)
+			}
+		case <-sess.closed:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2019-2020 IrineSistiana
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package core
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_udpFrame(t *testing.T) {
+	buf := new(bytes.Buffer)
+	datagrams := [][]byte{{}, []byte("hello"), make([]byte, maxUDPDatagramSize)}
+	for _, d := range datagrams {
+		if err := writeUDPFrame(buf, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := make([]byte, maxUDPDatagramSize)
+	for _, d := range datagrams {
+		n, err := readUDPFrame(buf, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:n], d) {
+			t.Fatalf("want datagram len %d, got %d", len(d), n)
+		}
+	}
+
+	if err := writeUDPFrame(buf, make([]byte, maxUDPDatagramSize+1)); err == nil {
+		t.Fatal("err is expected")
+	}
+}
+
+func Test_relayUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, maxUDPDatagramSize)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+
+	udpConn, err := net.Dial("udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, stream := net.Pipe()
+	defer local.Close()
+
+	relayErr := make(chan error, 1)
+	go func() {
+		relayErr <- relayUDP(stream, udpConn, time.Millisecond*500)
+	}()
+
+	local.SetDeadline(time.Now().Add(time.Second))
+	b := make([]byte, maxUDPDatagramSize)
+	for _, d := range [][]byte{[]byte("hello"), make([]byte, 4096)} {
+		if err := writeUDPFrame(local, d); err != nil {
+			t.Fatal(err)
+		}
+		n, err := readUDPFrame(local, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b[:n], d) {
+			t.Fatal("data err")
+		}
+	}
+
+	// relay should exit after being idle for timeout
+	select {
+	case err := <-relayErr:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("relay is still running after idle timeout")
+	}
+}
+
+func Test_relayUDP_slowFrame(t *testing.T) {
+	udpConn, dst := net.Pipe()
+	defer dst.Close()
+	local, stream := net.Pipe()
+	defer local.Close()
+
+	timeout := time.Millisecond * 300
+	go relayUDP(stream, udpConn, timeout)
+
+	// keep udp -> stream active
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-time.After(timeout / 3):
+				dst.Write([]byte("reply"))
+			case <-stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		b := make([]byte, maxUDPDatagramSize)
+		for {
+			if _, err := readUDPFrame(local, b); err != nil {
+				return
+			}
+		}
+	}()
+
+	// a frame is split and its second half is sent after timeout
+	frame := []byte{0, 5, 'h', 'e', 'l', 'l', 'o'}
+	if _, err := local.Write(frame[:1]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(timeout * 2)
+	if _, err := local.Write(frame[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	dst.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 16)
+	n, err := dst.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "hello" {
+		t.Fatalf("want hello, got %q", b[:n])
+	}
+}
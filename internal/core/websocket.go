@@ -34,6 +34,7 @@ var (
 	//smux subprotocol
 	websocketSubprotocolSmuxON  = "smux_on"
 	websocketSubprotocolSmuxOFF = "smux_off"
+	websocketSubprotocolYamux   = "yamux"
 )
 
 // webSocketConnWrapper is a wrapper for net.Conn over WebSocket connection.
@@ -88,9 +89,9 @@ func (c *webSocketConnWrapper) Close() error {
 
 func (c *webSocketConnWrapper) CloseWithDeadLine(t time.Duration) error {
 	c.closeOnce.Do(func() {
-		// set WriteDeadline to avoid sub conn blocking here forever!!
-		c.ws.SetWriteDeadline(time.Now().Add(t))
-		c.ws.WriteMessage(websocket.CloseMessage, websocketFormatCloseMessage)
+		// the deadline avoids sub conn blocking here forever!!
+		// WriteControl can be called concurrently with Write.
+		c.ws.WriteControl(websocket.CloseMessage, websocketFormatCloseMessage, time.Now().Add(t))
 	})
 	return c.ws.Close()
 }